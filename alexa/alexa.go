@@ -1,12 +1,15 @@
 package alexa
 
 import (
+	"fmt"
 	"homeautomation/apihelpers"
 	"homeautomation/rf"
+	"homeautomation/scene"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/davinche/glexa"
 )
@@ -21,10 +24,38 @@ var handleAlexaCommands http.HandlerFunc = func(w http.ResponseWriter, r *http.R
 	if err != nil {
 		log.Printf("error: could not parse alexa request body: %q\n", err)
 		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	if body.Request.Intent.Slots["scene"].Value != "" {
+		handleScenes(w, r, body)
+		return
 	}
 	handleSwitches(w, r, body)
 }
 
+// Scenes Alexa Request Handler
+func handleScenes(w http.ResponseWriter, r *http.Request, b *glexa.Body) {
+	response := glexa.NewResponse()
+	response.Response.ShouldEndSession = true
+
+	name := b.Request.Intent.Slots["scene"].Value
+	if !scene.Exists(name) {
+		response.Tell("I could not find that scene. Please try again.")
+		apihelpers.EncodeJSON(w, http.StatusOK, response)
+		return
+	}
+	response.Tell("Okay")
+	apihelpers.EncodeJSON(w, http.StatusOK, response)
+
+	// Scenes can take a while: run it after responding and log any failures
+	go func() {
+		results, err := scene.Run(name)
+		if err != nil || scene.Failed(results) {
+			log.Printf("error: scene %s did not complete successfully\n", name)
+		}
+	}()
+}
+
 // RF Switches Alexa Request Handler
 func handleSwitches(w http.ResponseWriter, r *http.Request, b *glexa.Body) {
 	response := glexa.NewResponse()
@@ -41,19 +72,114 @@ func handleSwitches(w http.ResponseWriter, r *http.Request, b *glexa.Body) {
 		return
 	}
 
-	switchNum, err := strconv.Atoi(b.Request.Intent.Slots["switch"].Value)
+	// The switch slot can name a single switch or a group of switches
+	switchID := b.Request.Intent.Slots["switch"].Value
+	_, _, err := rf.FindSwitch(switchID)
+	isGroup := false
 	if err != nil {
-		response.Tell("An error has occurred. Please try again.")
+		if _, err := rf.FindGroup(switchID); err != nil {
+			response.Tell("I could not find that switch. Please try again.")
+			apihelpers.EncodeJSON(w, http.StatusOK, response)
+			return
+		}
+		isGroup = true
+	}
+	switchStatus := strings.ToLower(b.Request.Intent.Slots["state"].Value)
+
+	// Without a state we report what the switch is doing
+	if switchStatus == "" && !isGroup {
+		response.Tell(describeState(switchID))
 		apihelpers.EncodeJSON(w, http.StatusOK, response)
 		return
 	}
-	switchStatus := strings.ToLower(b.Request.Intent.Slots["state"].Value)
+
+	if !rf.ValidState(switchStatus) {
+		response.Tell("You can turn a switch on, off or toggle it. Please try again.")
+		apihelpers.EncodeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	// "turn on switch two for ten minutes" sets the switch back afterwards
+	var duration time.Duration
+	if slot := b.Request.Intent.Slots["duration"].Value; slot != "" {
+		if isGroup {
+			response.Tell("I can only turn a single switch on or off for a while, not a group.")
+			apihelpers.EncodeJSON(w, http.StatusOK, response)
+			return
+		}
+		if duration, err = parseDuration(slot); err != nil || duration <= 0 {
+			response.Tell("I did not understand how long that should be. Please try again.")
+			apihelpers.EncodeJSON(w, http.StatusOK, response)
+			return
+		}
+	}
+
 	response.Tell("Okay")
 	apihelpers.EncodeJSON(w, http.StatusOK, response)
 
+	if duration > 0 {
+		go func() {
+			if _, err := rf.SetSwitchFor(switchID, switchStatus, duration); err != nil {
+				log.Printf("error: could not toggle switch %s %s for %s: %q\n", switchID, switchStatus, duration, err)
+			}
+		}()
+		return
+	}
+
 	// Log any errors if they occur
-	err = rf.SetSwitch(switchNum, switchStatus)
+	if isGroup {
+		err = rf.SetGroupAsync(switchID, switchStatus)
+	} else {
+		err = rf.SetSwitchAsync(switchID, switchStatus)
+	}
 	if err != nil {
-		log.Printf("error: could not toggle switch %d %s", switchNum, switchStatus)
+		log.Printf("error: could not toggle switch %s %s: %q\n", switchID, switchStatus, err)
+	}
+}
+
+// describeState tells what we last know about a switch
+func describeState(switchID string) string {
+	state, err := rf.GetState(switchID)
+	if err != nil || state.State == "" {
+		return "I don't know whether that switch is on or off."
+	}
+	return fmt.Sprintf("%s is %s.", state.Name, state.State)
+}
+
+// parseDuration converts an AMAZON.DURATION slot value (ISO 8601, e.g.
+// "PT10M" or "P1DT2H") into a time.Duration
+func parseDuration(iso string) (time.Duration, error) {
+	iso = strings.ToUpper(iso)
+	if !strings.HasPrefix(iso, "P") {
+		return 0, fmt.Errorf("error: invalid duration %q", iso)
+	}
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour, 'H': time.Hour, 'S': time.Second}
+	var total time.Duration
+	number := ""
+	inTime := false
+	for i := 1; i < len(iso); i++ {
+		c := iso[i]
+		switch {
+		case c >= '0' && c <= '9' || c == '.':
+			number += string(c)
+		case c == 'T':
+			inTime = true
+		default:
+			unit, ok := units[c]
+			if c == 'M' {
+				// M is minutes after the T, months before it
+				unit, ok = time.Minute, inTime
+			}
+			value, err := strconv.ParseFloat(number, 64)
+			if !ok || err != nil {
+				return 0, fmt.Errorf("error: invalid duration %q", iso)
+			}
+			total += time.Duration(value * float64(unit))
+			number = ""
+		}
+	}
+	if number != "" {
+		return 0, fmt.Errorf("error: invalid duration %q", iso)
 	}
+	return total, nil
 }
@@ -0,0 +1,34 @@
+package alexa
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		iso  string
+		want time.Duration
+		ok   bool
+	}{
+		{"PT10M", 10 * time.Minute, true},
+		{"pt10m", 10 * time.Minute, true},
+		{"PT1H30M", 90 * time.Minute, true},
+		{"PT45S", 45 * time.Second, true},
+		{"PT0.5S", 500 * time.Millisecond, true},
+		{"P1DT2H", 26 * time.Hour, true},
+		{"P1W", 7 * 24 * time.Hour, true},
+		{"P", 0, true},
+		{"10M", 0, false},
+		{"P1M", 0, false},
+		{"PT5", 0, false},
+		{"PTH", 0, false},
+		{"PT1X", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseDuration(test.iso)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("%q: got %s, %v, want %s", test.iso, got, err, test.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package apihelpers
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 )
 
 // EncodeJSON takes an http.ResponseWriter, status code and message
@@ -21,3 +22,10 @@ func EncodeError(w http.ResponseWriter, code int, message interface{}) {
 	data["error"] = message
 	EncodeJSON(w, code, data)
 }
+
+// EncodeMethodNotAllowed responds with a 405 JSON error listing the
+// methods that are allowed in the "Allow" header
+func EncodeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	EncodeError(w, http.StatusMethodNotAllowed, "Method Not Allowed: use "+strings.Join(allowed, " or "))
+}
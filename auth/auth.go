@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"homeautomation/apihelpers"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Scopes a key can have
+// read: only GET and HEAD requests that don't set a state
+// control: every request
+const (
+	ScopeRead    = "read"
+	ScopeControl = "control"
+)
+
+// Key is an API key and what it's allowed to do
+type Key struct {
+	Name  string `json:"name"`
+	Key   string `json:"key"`
+	Scope string `json:"scope"`
+}
+
+// Authenticator checks API keys sent as "Authorization: Bearer <key>" or
+// "X-API-Key: <key>" headers
+type Authenticator struct {
+	keys []Key
+}
+
+// New validates the keys and creates an authenticator for them
+func New(keys []Key) (*Authenticator, error) {
+	names := make(map[string]bool)
+	for i, k := range keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("error: api key %d: missing name", i)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("error: api key %q: duplicate name", k.Name)
+		}
+		names[k.Name] = true
+		if len(k.Key) < 16 {
+			return nil, fmt.Errorf("error: api key %q: keys must be at least 16 characters", k.Name)
+		}
+		if k.Scope != ScopeRead && k.Scope != ScopeControl {
+			return nil, fmt.Errorf("error: api key %q: scope must be %q or %q", k.Name, ScopeRead, ScopeControl)
+		}
+	}
+	return &Authenticator{keys: keys}, nil
+}
+
+// Enabled reports whether any keys are configured
+func (a *Authenticator) Enabled() bool {
+	return len(a.keys) > 0
+}
+
+// credential pulls the API key out of a request
+func credential(r *http.Request) (string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		parts := strings.SplitN(header, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return "", errors.New("Authorization Header Must Be a Bearer Token")
+		}
+		return strings.TrimSpace(parts[1]), nil
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, nil
+	}
+	return "", errors.New("Missing API Key")
+}
+
+// find the key matching a credential, comparing in constant time
+func (a *Authenticator) find(credential string) (Key, bool) {
+	var found Key
+	ok := false
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(credential)) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+// allowed reports whether a key's scope permits the request. Read keys can
+// only GET and HEAD, and never with a state to set.
+func allowed(k Key, r *http.Request) bool {
+	if k.Scope == ScopeControl {
+		return true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return r.URL.Query().Get("state") == ""
+}
+
+// Wrap requires every request to h to carry a key whose scope allows it.
+// Without any keys configured requests pass through unchecked.
+func (a *Authenticator) Wrap(h http.Handler) http.Handler {
+	if len(a.keys) == 0 {
+		log.Println("warning: no api keys configured: the api is not authenticated")
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, err := credential(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="homeautomation"`)
+			apihelpers.EncodeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		k, ok := a.find(cred)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="homeautomation", error="invalid_token"`)
+			apihelpers.EncodeError(w, http.StatusUnauthorized, "Invalid API Key")
+			return
+		}
+		if !allowed(k, r) {
+			log.Printf("error: api key %q is not allowed to %s %s\n", k.Name, r.Method, r.URL.Path)
+			apihelpers.EncodeError(w, http.StatusForbidden, "API Key Is Read Only")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
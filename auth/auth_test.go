@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"homeautomation/rf"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	readKey    = "read-only-key-0123456789"
+	controlKey = "control-key-0123456789"
+)
+
+// the real switch handlers behind the authenticator, transmitting to a recorder
+func setup(t *testing.T) (http.Handler, *rf.Recorder) {
+	recorder := &rf.Recorder{}
+	rf.SetTransmitter(recorder)
+	rf.SetQueue(rf.NewQueue(rf.QueueConfig{}))
+	if err := rf.SetSwitches([]rf.Switch{{Name: "porch", On: 1, Off: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.SetGroups(nil); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New([]Key{
+		{Name: "dashboard", Key: readKey, Scope: ScopeRead},
+		{Name: "phone", Key: controlKey, Scope: ScopeControl},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/switch", rf.SwitchHandler)
+	mux.HandleFunc("/api/group", rf.GroupHandler)
+	return a.Wrap(mux), recorder
+}
+
+func TestScopes(t *testing.T) {
+	api, recorder := setup(t)
+	tests := []struct {
+		method, url, key string
+		code             int
+	}{
+		{"GET", "/api/switch?switch=porch", "", http.StatusUnauthorized},
+		{"GET", "/api/switch?switch=porch", "not-a-key-0123456789", http.StatusUnauthorized},
+		{"GET", "/api/switch?switch=porch", readKey, http.StatusOK},
+		{"GET", "/api/group", readKey, http.StatusOK},
+		{"GET", "/api/switch?switch=porch&state=on", readKey, http.StatusForbidden},
+		{"GET", "/api/group?group=all&state=off", readKey, http.StatusForbidden},
+		{"POST", "/api/switch?switch=porch&state=on", readKey, http.StatusForbidden},
+		{"PUT", "/api/group?group=all&state=off", readKey, http.StatusForbidden},
+		{"GET", "/api/switch?switch=porch&state=on", controlKey, http.StatusMethodNotAllowed},
+		{"GET", "/api/group?group=all&state=off", controlKey, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		if test.key != "" {
+			r.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s with %q: got %d, want %d", test.method, test.url, test.key, w.Code, test.code)
+		}
+	}
+	if n := len(recorder.Transmissions()); n != 0 {
+		t.Errorf("got %d transmissions, want none", n)
+	}
+
+	// control keys can still set switches
+	r := httptest.NewRequest("POST", "/api/switch?switch=porch&state=on", nil)
+	r.Header.Set("X-API-Key", controlKey)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST with control key: got %d: %s", w.Code, w.Body)
+	}
+	if len(recorder.Transmissions()) == 0 {
+		t.Error("POST with control key: nothing transmitted")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		keys []Key
+		ok   bool
+	}{
+		{nil, true},
+		{[]Key{{Name: "a", Key: readKey, Scope: ScopeRead}}, true},
+		{[]Key{{Key: readKey, Scope: ScopeRead}}, false},
+		{[]Key{{Name: "a", Key: "short", Scope: ScopeRead}}, false},
+		{[]Key{{Name: "a", Key: readKey, Scope: "admin"}}, false},
+		{[]Key{{Name: "a", Key: readKey, Scope: ScopeRead}, {Name: "a", Key: controlKey, Scope: ScopeControl}}, false},
+	}
+	for i, test := range tests {
+		if _, err := New(test.keys); (err == nil) != test.ok {
+			t.Errorf("%d: got error %v, want ok %v", i, err, test.ok)
+		}
+	}
+}
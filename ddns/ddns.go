@@ -8,7 +8,6 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -17,7 +16,7 @@ var externalIPAPI = "http://checkip.amazonaws.com/"
 
 // PUT payload for updating the dns record
 type updatePayload struct {
-	ID      string `json:"id"`
+	ID      string `json:"id,omitempty"`
 	Name    string `json:"name"`
 	Type    string `json:"type"`
 	Content string `json:"content"`
@@ -149,27 +148,14 @@ func (d *DNSUpdater) updateRecord() {
 	}
 
 	// Check to see if we got a success
+	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusOK {
 		log.Printf("update success: record %q, ip %q\n", d.Record+"."+d.Domain, ip)
 		return
 	}
 
 	// log any errors from cloudflare
-	errorsStruct := cloudflareErrors{}
-	errorDecoder := json.NewDecoder(resp.Body)
-	err = errorDecoder.Decode(&errorsStruct)
-	if err != nil {
-		log.Printf("error: got non-200 from cloudflare: could not decode error response: %q\n", err)
-		return
-	}
-	for _, errorMsg := range errorsStruct.Errors {
-		log.Printf("error from cloudflare: %q\n", errorMsg.Message)
-		var errorChain []string
-		for _, chain := range errorMsg.ErrorChain {
-			errorChain = append(errorChain, chain.Message)
-		}
-		log.Printf("error chain: %s", strings.Join(errorChain, ","))
-	}
+	log.Println(cloudflareError(resp))
 }
 
 // utility to set API call auth headers
@@ -0,0 +1,104 @@
+package ddns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// turn a non-200 cloudflare response into an error
+func cloudflareError(resp *http.Response) error {
+	errorsStruct := cloudflareErrors{}
+	if err := json.NewDecoder(resp.Body).Decode(&errorsStruct); err != nil || len(errorsStruct.Errors) == 0 {
+		return fmt.Errorf("error: got %s from cloudflare", resp.Status)
+	}
+	var messages []string
+	for _, errorMsg := range errorsStruct.Errors {
+		messages = append(messages, errorMsg.Message)
+		for _, chain := range errorMsg.ErrorChain {
+			messages = append(messages, chain.Message)
+		}
+	}
+	return fmt.Errorf("error from cloudflare: %s", strings.Join(messages, ","))
+}
+
+// CreateTXTRecord adds a TXT record to the zone and returns its record ID
+func (d *DNSUpdater) CreateTXTRecord(name, content string) (string, error) {
+	// make sure we know which zone the record goes in
+	if d.ZoneID == "" {
+		if err := d.updateZoneID(); err != nil {
+			return "", err
+		}
+	}
+
+	payload := updatePayload{
+		Name:    name,
+		Type:    "TXT",
+		Content: content,
+		TTL:     120,
+	}
+	buf := bytes.Buffer{}
+	if err := json.NewEncoder(&buf).Encode(&payload); err != nil {
+		return "", err
+	}
+
+	dnsRecordsURL := fmt.Sprintf("%s/zones/%s/dns_records", cloudflareAPI, d.ZoneID)
+	request, err := http.NewRequest("POST", dnsRecordsURL, &buf)
+	if err != nil {
+		return "", err
+	}
+	d.setAuthHeaders(request)
+	request.Header.Add("Content-Type", "application/json")
+	client := http.Client{}
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", cloudflareError(resp)
+	}
+
+	// decode the new record
+	recordStruct := struct {
+		Result struct {
+			ID string `json:"id"`
+		} `json:"result"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&recordStruct); err != nil {
+		return "", err
+	}
+	if recordStruct.Result.ID == "" {
+		return "", errors.New("error: cloudflare did not return the new record")
+	}
+	return recordStruct.Result.ID, nil
+}
+
+// DeleteRecord removes a dns record from the zone
+func (d *DNSUpdater) DeleteRecord(recordID string) error {
+	if d.ZoneID == "" {
+		if err := d.updateZoneID(); err != nil {
+			return err
+		}
+	}
+
+	dnsRecordURL := fmt.Sprintf("%s/zones/%s/dns_records/%s", cloudflareAPI, d.ZoneID, recordID)
+	request, err := http.NewRequest("DELETE", dnsRecordURL, nil)
+	if err != nil {
+		return err
+	}
+	d.setAuthHeaders(request)
+	client := http.Client{}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return cloudflareError(resp)
+	}
+	return nil
+}
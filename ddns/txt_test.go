@@ -0,0 +1,65 @@
+package ddns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fake cloudflare API with a single zone
+func fakeCloudflare(t *testing.T, created *map[string]interface{}, deleted *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Email") != "me@example.com" || r.Header.Get("X-Auth-Key") != "key" {
+			t.Errorf("%s %s: missing auth headers", r.Method, r.URL.Path)
+		}
+		switch {
+		case r.URL.Path == "/zones":
+			w.Write([]byte(`{"result":[{"id":"zone"}]}`))
+		case r.Method == "POST" && r.URL.Path == "/zones/zone/dns_records":
+			json.NewDecoder(r.Body).Decode(created)
+			w.Write([]byte(`{"success":true,"result":{"id":"record"}}`))
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/zones/zone/dns_records/"):
+			*deleted = strings.TrimPrefix(r.URL.Path, "/zones/zone/dns_records/")
+			if *deleted != "record" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[{"message":"Record not found","error_chain":[{"message":"bad id"}]}]}`))
+				return
+			}
+			w.Write([]byte(`{"success":true}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestTXTRecords(t *testing.T) {
+	var created map[string]interface{}
+	var deleted string
+	server := fakeCloudflare(t, &created, &deleted)
+	defer server.Close()
+	defer func(api string) { cloudflareAPI = api }(cloudflareAPI)
+	cloudflareAPI = server.URL
+
+	d := NewUpdater("me@example.com", "key", "example.com", "home")
+	id, err := d.CreateTXTRecord("_acme-challenge.home.example.com", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "record" {
+		t.Errorf("got record id %q", id)
+	}
+	if _, ok := created["id"]; ok || created["type"] != "TXT" || created["content"] != "value" ||
+		created["name"] != "_acme-challenge.home.example.com" {
+		t.Errorf("created %v", created)
+	}
+
+	if err := d.DeleteRecord("record"); err != nil || deleted != "record" {
+		t.Errorf("delete: %v", err)
+	}
+	err = d.DeleteRecord("missing")
+	if err == nil || !strings.Contains(err.Error(), "Record not found,bad id") {
+		t.Errorf("got error %v", err)
+	}
+}
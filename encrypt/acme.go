@@ -0,0 +1,388 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LetsEncryptAPI is the directory of Let's Encrypt's production ACME v2 API
+const LetsEncryptAPI = "https://acme-v02.api.letsencrypt.org/directory"
+
+// how long to wait for authorizations and orders to be processed
+const acmePollTimeout = 2 * time.Minute
+
+// ACME directory of endpoints (RFC 8555 section 7.1.1)
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeProblem is an error document returned by the ACME server
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+// ACME order (RFC 8555 section 7.1.3)
+type acmeOrder struct {
+	URL            string       `json:"-"`
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+// ACME challenge (RFC 8555 section 7.1.5)
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// ACME authorization (RFC 8555 section 7.1.4)
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeClient speaks the RFC 8555 protocol on behalf of an account key
+type acmeClient struct {
+	directoryURL string
+	httpClient   *http.Client
+	key          *rsa.PrivateKey
+	accountURL   string
+	dir          *acmeDirectory
+
+	noncesMu sync.Mutex
+	nonces   []string
+}
+
+func newACMEClient(directoryURL string, key *rsa.PrivateKey, httpClient *http.Client) *acmeClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &acmeClient{directoryURL: directoryURL, key: key, httpClient: httpClient}
+}
+
+// base64url without padding, as used throughout JWS
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// fetch (once) the directory of endpoints
+func (c *acmeClient) directory() (*acmeDirectory, error) {
+	if c.dir != nil {
+		return c.dir, nil
+	}
+	resp, err := c.httpClient.Get(c.directoryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error: could not fetch acme directory: %s", resp.Status)
+	}
+	dir := &acmeDirectory{}
+	if err := json.NewDecoder(resp.Body).Decode(dir); err != nil {
+		return nil, err
+	}
+	c.dir = dir
+	return dir, nil
+}
+
+// remember the nonce handed out with a response
+func (c *acmeClient) saveNonce(resp *http.Response) {
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		c.noncesMu.Lock()
+		c.nonces = append(c.nonces, nonce)
+		c.noncesMu.Unlock()
+	}
+}
+
+// get an unused nonce, asking the server for a new one if needed
+func (c *acmeClient) nonce() (string, error) {
+	c.noncesMu.Lock()
+	if n := len(c.nonces); n > 0 {
+		nonce := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		c.noncesMu.Unlock()
+		return nonce, nil
+	}
+	c.noncesMu.Unlock()
+
+	dir, err := c.directory()
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Head(dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("error: acme server did not return a nonce")
+	}
+	return nonce, nil
+}
+
+// the account key as a JSON Web Key. Members are in lexicographic order as
+// required for the thumbprint (RFC 7638).
+func (c *acmeClient) jwk() map[string]string {
+	return map[string]string{
+		"e":   b64(big.NewInt(int64(c.key.PublicKey.E)).Bytes()),
+		"kty": "RSA",
+		"n":   b64(c.key.PublicKey.N.Bytes()),
+	}
+}
+
+// keyAuthorization is the response to a challenge token (RFC 8555 section 8.1)
+func (c *acmeClient) keyAuthorization(token string) string {
+	jwk, _ := json.Marshal(c.jwk())
+	thumbprint := sha256.Sum256(jwk)
+	return token + "." + b64(thumbprint[:])
+}
+
+// sign a payload for a url as a flattened JWS. Before the account exists
+// the key itself is embedded, afterwards the account url identifies it.
+func (c *acmeClient) sign(url string, payload []byte) ([]byte, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	protected := map[string]interface{}{"alg": "RS256", "nonce": nonce, "url": url}
+	if c.accountURL == "" {
+		protected["jwk"] = c.jwk()
+	} else {
+		protected["kid"] = c.accountURL
+	}
+	protectedJSON, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := b64(protectedJSON) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]string{
+		"protected": b64(protectedJSON),
+		"payload":   b64(payload),
+		"signature": b64(signature),
+	})
+}
+
+// post a signed payload and return the response body. A nil payload is a
+// POST-as-GET. Bad nonces are retried once; error documents become errors.
+func (c *acmeClient) post(url string, payload interface{}, accept string) (*http.Response, []byte, error) {
+	var payloadJSON []byte
+	if payload != nil {
+		var err error
+		if payloadJSON, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		body, err := c.sign(url, payloadJSON)
+		if err != nil {
+			return nil, nil, err
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		c.saveNonce(resp)
+
+		if resp.StatusCode < 400 {
+			return resp, respBody, nil
+		}
+		problem := &acmeProblem{Status: resp.StatusCode}
+		if err := json.Unmarshal(respBody, problem); err != nil || problem.Type == "" {
+			return nil, nil, fmt.Errorf("error: acme request to %s failed: %s", url, resp.Status)
+		}
+		if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+			continue
+		}
+		return nil, nil, problem
+	}
+}
+
+// post and decode the JSON response into result
+func (c *acmeClient) postJSON(url string, payload, result interface{}) (*http.Response, error) {
+	resp, body, err := c.post(url, payload, "")
+	if err != nil {
+		return nil, err
+	}
+	if result != nil {
+		if err := json.Unmarshal(body, result); err != nil {
+			return nil, fmt.Errorf("error: could not decode acme response from %s: %q", url, err)
+		}
+	}
+	return resp, nil
+}
+
+// register creates the account for the key, or finds the existing one
+func (c *acmeClient) register() error {
+	dir, err := c.directory()
+	if err != nil {
+		return err
+	}
+	c.accountURL = ""
+	resp, err := c.postJSON(dir.NewAccount, map[string]interface{}{"termsOfServiceAgreed": true}, nil)
+	if err != nil {
+		return err
+	}
+	c.accountURL = resp.Header.Get("Location")
+	if c.accountURL == "" {
+		return errors.New("error: acme server did not return an account url")
+	}
+	return nil
+}
+
+// newOrder asks for a certificate for the domain
+func (c *acmeClient) newOrder(domain string) (*acmeOrder, error) {
+	dir, err := c.directory()
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{
+		"identifiers": []map[string]string{{"type": "dns", "value": domain}},
+	}
+	order := &acmeOrder{}
+	resp, err := c.postJSON(dir.NewOrder, payload, order)
+	if err != nil {
+		return nil, err
+	}
+	order.URL = resp.Header.Get("Location")
+	return order, nil
+}
+
+// authorization fetches an authorization and its challenges
+func (c *acmeClient) authorization(url string) (*acmeAuthorization, error) {
+	authz := &acmeAuthorization{}
+	if _, err := c.postJSON(url, nil, authz); err != nil {
+		return nil, err
+	}
+	return authz, nil
+}
+
+// accept tells the server a challenge is ready to be validated
+func (c *acmeClient) accept(challengeURL string) error {
+	_, err := c.postJSON(challengeURL, struct{}{}, nil)
+	return err
+}
+
+// poll a resource until done reports it has settled
+func (c *acmeClient) poll(url string, result interface{}, done func() (bool, error)) error {
+	deadline := time.Now().Add(acmePollTimeout)
+	for {
+		resp, err := c.postJSON(url, nil, result)
+		if err != nil {
+			return err
+		}
+		if finished, err := done(); finished || err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("error: timed out waiting for %s", url)
+		}
+		wait := 2 * time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		<-time.After(wait)
+	}
+}
+
+// waitAuthorization polls an authorization until it is valid
+func (c *acmeClient) waitAuthorization(url string) error {
+	authz := &acmeAuthorization{}
+	return c.poll(url, authz, func() (bool, error) {
+		switch authz.Status {
+		case "valid":
+			return true, nil
+		case "pending", "processing":
+			return false, nil
+		}
+		for _, challenge := range authz.Challenges {
+			if challenge.Error != nil {
+				return true, fmt.Errorf("error: authorization %s: %v", authz.Status, challenge.Error)
+			}
+		}
+		return true, fmt.Errorf("error: authorization is %s", authz.Status)
+	})
+}
+
+// finalize submits the CSR and waits for the certificate to be issued
+func (c *acmeClient) finalize(order *acmeOrder, csrDER []byte) (*acmeOrder, error) {
+	finalized := &acmeOrder{}
+	if _, err := c.postJSON(order.Finalize, map[string]string{"csr": b64(csrDER)}, finalized); err != nil {
+		return nil, err
+	}
+	finalized.URL = order.URL
+	if finalized.Status == "valid" {
+		return finalized, nil
+	}
+	err := c.poll(order.URL, finalized, func() (bool, error) {
+		switch finalized.Status {
+		case "valid":
+			return true, nil
+		case "pending", "ready", "processing":
+			return false, nil
+		}
+		if finalized.Error != nil {
+			return true, fmt.Errorf("error: order %s: %v", finalized.Status, finalized.Error)
+		}
+		return true, fmt.Errorf("error: order is %s", finalized.Status)
+	})
+	finalized.URL = order.URL
+	return finalized, err
+}
+
+// certificate downloads the issued certificate chain as PEM
+func (c *acmeClient) certificate(url string) ([]byte, error) {
+	_, body, err := c.post(url, nil, "application/pem-certificate-chain")
+	return body, err
+}
@@ -0,0 +1,391 @@
+package encrypt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acmeStub is a minimal RFC 8555 server. It checks nonces, urls and
+// signatures of every request, rejects the first new order with a bad nonce
+// and requires the http-01 key authorization to be presented before the
+// challenge is accepted.
+type acmeStub struct {
+	t      *testing.T
+	server *httptest.Server
+	solver *recordingSolver
+
+	mu          sync.Mutex
+	nonces      map[string]bool
+	nonceCount  int
+	accountKey  *rsa.PublicKey
+	authzStatus string
+	orderStatus string
+	badNonces   int
+	orders      int
+	chain       []byte
+	caKey       *rsa.PrivateKey
+	caDER       []byte
+}
+
+// recordingSolver keeps the key authorizations it was asked to present
+type recordingSolver struct {
+	mu        sync.Mutex
+	presented map[string]string
+}
+
+func (s *recordingSolver) Type() string { return "http-01" }
+
+func (s *recordingSolver) Present(domain, token, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.presented[token] = keyAuth
+	return nil
+}
+
+func (s *recordingSolver) CleanUp(domain, token, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.presented, token)
+	return nil
+}
+
+func (s *recordingSolver) get(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keyAuth, ok := s.presented[token]
+	return keyAuth, ok
+}
+
+func newACMEStub(t *testing.T) *acmeStub {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stub ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &acmeStub{
+		t:           t,
+		solver:      &recordingSolver{presented: map[string]string{}},
+		nonces:      map[string]bool{},
+		authzStatus: "pending",
+		caKey:       caKey,
+		caDER:       caDER,
+	}
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *acmeStub) url(path string) string {
+	return s.server.URL + path
+}
+
+func (s *acmeStub) newNonce(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonceCount++
+	nonce := fmt.Sprintf("nonce-%d", s.nonceCount)
+	s.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (s *acmeStub) problem(w http.ResponseWriter, code int, kind, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:" + kind, Detail: detail, Status: code})
+}
+
+// verify checks the JWS of a request and returns its payload
+func (s *acmeStub) verify(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if r.Method != "POST" || r.Header.Get("Content-Type") != "application/jose+json" {
+		s.t.Errorf("%s %s: want a POST of application/jose+json", r.Method, r.URL.Path)
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		s.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return nil, false
+	}
+	protectedJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg   string            `json:"alg"`
+		Nonce string            `json:"nonce"`
+		URL   string            `json:"url"`
+		Kid   string            `json:"kid"`
+		JWK   map[string]string `json:"jwk"`
+	}
+	json.Unmarshal(protectedJSON, &protected)
+	if protected.Alg != "RS256" || protected.URL != s.url(r.URL.Path) {
+		s.t.Errorf("%s: bad protected header %s", r.URL.Path, protectedJSON)
+	}
+
+	s.mu.Lock()
+	validNonce := s.nonces[protected.Nonce]
+	delete(s.nonces, protected.Nonce)
+	rejectNonce := r.URL.Path == "/new-order" && s.badNonces == 0
+	if rejectNonce {
+		s.badNonces++
+	}
+	s.mu.Unlock()
+	if !validNonce {
+		s.t.Errorf("%s: unknown nonce %q", r.URL.Path, protected.Nonce)
+	}
+	if rejectNonce {
+		s.problem(w, http.StatusBadRequest, "badNonce", "stale nonce")
+		return nil, false
+	}
+
+	// new accounts embed the key, everything else uses the account url
+	var key *rsa.PublicKey
+	if r.URL.Path == "/new-account" {
+		if protected.JWK == nil || protected.Kid != "" {
+			s.t.Errorf("new account: want a jwk, got %s", protectedJSON)
+		}
+		n, _ := base64.RawURLEncoding.DecodeString(protected.JWK["n"])
+		e, _ := base64.RawURLEncoding.DecodeString(protected.JWK["e"])
+		key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		s.mu.Lock()
+		s.accountKey = key
+		s.mu.Unlock()
+	} else {
+		if protected.Kid != s.url("/account/1") || protected.JWK != nil {
+			s.t.Errorf("%s: want kid, got %s", r.URL.Path, protectedJSON)
+		}
+		s.mu.Lock()
+		key = s.accountKey
+		s.mu.Unlock()
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if key == nil || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		s.problem(w, http.StatusUnauthorized, "unauthorized", "bad signature")
+		return nil, false
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, true
+}
+
+func (s *acmeStub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(acmeDirectory{
+			NewNonce:   s.url("/new-nonce"),
+			NewAccount: s.url("/new-account"),
+			NewOrder:   s.url("/new-order"),
+		})
+		return
+	}
+	s.newNonce(w)
+	if r.URL.Path == "/new-nonce" {
+		return
+	}
+	payload, ok := s.verify(w, r)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/new-account":
+		w.Header().Set("Location", s.url("/account/1"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"status":"valid"}`)
+	case "/new-order":
+		s.orders++
+		w.Header().Set("Location", s.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"status":"pending","authorizations":[%q],"finalize":%q}`, s.url("/authz/1"), s.url("/finalize/1"))
+	case "/authz/1":
+		if len(payload) != 0 {
+			s.t.Errorf("authorization: want POST-as-GET, got payload %q", payload)
+		}
+		fmt.Fprintf(w, `{"status":%q,"identifier":{"type":"dns","value":"example.com"},"challenges":[`+
+			`{"type":"dns-01","url":%q,"token":"dns-token"},{"type":"http-01","url":%q,"token":"http-token"}]}`,
+			s.authzStatus, s.url("/challenge/dns"), s.url("/challenge/http"))
+	case "/challenge/http":
+		if string(payload) != "{}" {
+			s.t.Errorf("challenge: want {} payload, got %q", payload)
+		}
+		jwk, _ := json.Marshal(map[string]string{
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.accountKey.E)).Bytes()),
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(s.accountKey.N.Bytes()),
+		})
+		thumbprint := sha256.Sum256(jwk)
+		want := "http-token." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+		if got, _ := s.solver.get("http-token"); got != want {
+			s.t.Errorf("challenge: presented %q, want %q", got, want)
+		}
+		s.authzStatus = "valid"
+		fmt.Fprint(w, `{"status":"processing"}`)
+	case "/finalize/1":
+		var request struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &request)
+		der, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			s.problem(w, http.StatusBadRequest, "badCSR", "invalid csr")
+			return
+		}
+		ca, _ := x509.ParseCertificate(s.caDER)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(s.orders + 1)),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		leaf, _ := x509.CreateCertificate(rand.Reader, template, ca, csr.PublicKey, s.caKey)
+		s.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caDER})...)
+		s.orderStatus = "processing"
+		w.Header().Set("Retry-After", "1")
+		fmt.Fprintf(w, `{"status":"processing","finalize":%q}`, s.url("/finalize/1"))
+	case "/order/1":
+		status := s.orderStatus
+		s.orderStatus = "valid"
+		fmt.Fprintf(w, `{"status":%q,"certificate":%q}`, status, s.url("/certificate/1"))
+	case "/certificate/1":
+		if r.Header.Get("Accept") != "application/pem-certificate-chain" {
+			s.t.Errorf("certificate: bad accept header %q", r.Header.Get("Accept"))
+		}
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(s.chain)
+	default:
+		s.problem(w, http.StatusNotFound, "malformed", "no such resource")
+	}
+}
+
+// run the test in an empty directory as keys and certificates go in the
+// working directory
+func inTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+}
+
+func TestBootstrap(t *testing.T) {
+	inTempDir(t)
+	stub := newACMEStub(t)
+	defer stub.server.Close()
+
+	d := NewDomain("example.com", stub.url("/directory"))
+	d.HTTPClient = stub.server.Client()
+	d.Solver = stub.solver
+	if err := d.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPair, err := d.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyPair.Certificate) != 2 {
+		t.Errorf("got %d certificates, want the leaf and its issuer", len(keyPair.Certificate))
+	}
+	if names := d.certificate.DNSNames; len(names) != 1 || names[0] != "example.com" {
+		t.Errorf("got certificate for %v", names)
+	}
+	if stub.badNonces != 1 {
+		t.Errorf("got %d bad nonces, want 1", stub.badNonces)
+	}
+	if _, ok := stub.solver.get("http-token"); ok {
+		t.Error("challenge was not cleaned up")
+	}
+	for _, file := range []string{"auth.key", "example.com.key", "example.com.crt"} {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("%s not written: %v", file, err)
+		}
+	}
+
+	// renewal places a new order with the same account
+	first := d.certificate
+	if err := d.requestCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if d.certificate.Equal(first) || stub.orders != 2 {
+		t.Errorf("renewal did not issue a new certificate")
+	}
+}
+
+func TestBootstrapOffline(t *testing.T) {
+	inTempDir(t)
+	stub := newACMEStub(t)
+	d := NewDomain("example.com", stub.url("/directory"))
+	d.HTTPClient = stub.server.Client()
+	d.Solver = stub.solver
+	if err := d.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a certificate on disk is served even when the ACME server is down
+	stub.server.Close()
+	offline := NewDomain("example.com", stub.url("/directory"))
+	if err := offline.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := offline.GetCertificate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !offline.certificate.Equal(d.certificate) {
+		t.Error("did not reuse the certificate on disk")
+	}
+}
+
+func TestKeyAuthorization(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newACMEClient("", key, nil)
+	jwk := fmt.Sprintf(`{"e":"AQAB","kty":"RSA","n":"%s"}`, base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+	thumbprint := sha256.Sum256([]byte(jwk))
+	want := "token." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	if got := c.keyAuthorization("token"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
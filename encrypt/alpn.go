@@ -0,0 +1,118 @@
+package encrypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACMETLSProto is the ALPN protocol of tls-alpn-01 validation requests. It
+// has to be in the TLS listener's NextProtos.
+const ACMETLSProto = "acme-tls/1"
+
+// id-pe-acmeIdentifier (RFC 8737 section 6.1)
+var acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// TLSALPNSolver solves tls-alpn-01 challenges on the TLS listener. The
+// listener's GetCertificate must be Domain.GetCertificate, which hands out
+// the challenge certificate to validation requests.
+type TLSALPNSolver struct {
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// NewTLSALPNSolver creates a tls-alpn-01 solver
+func NewTLSALPNSolver() *TLSALPNSolver {
+	return &TLSALPNSolver{certs: map[string]*tls.Certificate{}}
+}
+
+// Type returns "tls-alpn-01"
+func (s *TLSALPNSolver) Type() string {
+	return "tls-alpn-01"
+}
+
+// Present creates the challenge certificate for the domain
+func (s *TLSALPNSolver) Present(domain, token, keyAuth string) error {
+	cert, err := challengeCertificate(domain, keyAuth)
+	if err != nil {
+		return fmt.Errorf("error: could not create challenge certificate: %q\n", err)
+	}
+	s.mu.Lock()
+	s.certs[strings.ToLower(domain)] = cert
+	s.mu.Unlock()
+	return nil
+}
+
+// CleanUp stops serving the challenge certificate for the domain
+func (s *TLSALPNSolver) CleanUp(domain, token, keyAuth string) error {
+	s.mu.Lock()
+	delete(s.certs, strings.ToLower(domain))
+	s.mu.Unlock()
+	return nil
+}
+
+// certificate returns the challenge certificate for a validation request
+func (s *TLSALPNSolver) certificate(serverName string) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cert, ok := s.certs[strings.ToLower(serverName)]
+	if !ok {
+		return nil, fmt.Errorf("error: no tls-alpn-01 challenge for %q", serverName)
+	}
+	return cert, nil
+}
+
+// isACMETLS reports whether the client is an ACME server validating a
+// tls-alpn-01 challenge
+func isACMETLS(hello *tls.ClientHelloInfo) bool {
+	for _, proto := range hello.SupportedProtos {
+		if proto == ACMETLSProto {
+			return true
+		}
+	}
+	return false
+}
+
+// challengeCertificate creates the self-signed certificate carrying the
+// digest of the key authorization in a critical acmeIdentifier extension
+func challengeCertificate(domain, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	extension, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ACME challenge"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{domain},
+		ExtraExtensions: []pkix.Extension{
+			{Id: acmeIdentifierOID, Critical: true, Value: extension},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,70 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestTLSALPNSolver(t *testing.T) {
+	inTempDir(t)
+	current := writeCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	solver := NewTLSALPNSolver()
+	d := NewDomain("example.com", "")
+	d.Solver = solver
+	if err := d.loadKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+
+	const keyAuth = "token.thumbprint"
+	if err := solver.Present("Example.com", "token", keyAuth); err != nil {
+		t.Fatal(err)
+	}
+
+	// validation requests get the challenge certificate
+	challenge := handshake(t, d, ACMETLSProto)
+	if names := challenge.DNSNames; len(names) != 1 || names[0] != "Example.com" {
+		t.Errorf("challenge certificate is for %v, want the domain", names)
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	// DER OCTET STRING of the 32 byte digest
+	want := append([]byte{0x04, 0x20}, digest[:]...)
+	found := false
+	for _, extension := range challenge.Extensions {
+		if !extension.Id.Equal(acmeIdentifierOID) {
+			continue
+		}
+		found = true
+		if !extension.Critical {
+			t.Error("acmeIdentifier extension is not critical")
+		}
+		if !bytes.Equal(extension.Value, want) {
+			t.Errorf("acmeIdentifier is %x, want %x", extension.Value, want)
+		}
+	}
+	if !found {
+		t.Error("no acmeIdentifier extension")
+	}
+
+	// everyone else still gets the real certificate
+	for _, protos := range [][]string{nil, {"h2", "http/1.1"}} {
+		if served := handshake(t, d, protos...); !served.Equal(current) {
+			t.Errorf("protocols %v: got the challenge certificate", protos)
+		}
+	}
+
+	// nothing is served for other domains or once the challenge is done
+	hello := &tls.ClientHelloInfo{ServerName: "other.com", SupportedProtos: []string{ACMETLSProto}}
+	if _, err := d.GetCertificate(hello); err == nil {
+		t.Error("served a challenge certificate for another domain")
+	}
+	if err := solver.CleanUp("example.com", "token", keyAuth); err != nil {
+		t.Fatal(err)
+	}
+	hello.ServerName = "example.com"
+	if _, err := d.GetCertificate(hello); err == nil {
+		t.Error("served a challenge certificate after clean up")
+	}
+}
@@ -0,0 +1,160 @@
+package encrypt
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSProvider manages the TXT records used for dns-01 challenges
+type DNSProvider interface {
+	CreateTXTRecord(name, content string) (string, error)
+	DeleteRecord(recordID string) error
+}
+
+// DNSSolver solves dns-01 challenges with _acme-challenge TXT records
+type DNSSolver struct {
+	Provider DNSProvider
+	// how long to wait for the record to reach the authoritative nameservers
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	records map[string]string
+	// waits for the record to propagate
+	wait func(name, value string, timeout time.Duration) error
+}
+
+// NewDNSSolver creates a dns-01 solver using the provider's records
+func NewDNSSolver(provider DNSProvider) *DNSSolver {
+	return &DNSSolver{Provider: provider, Timeout: 5 * time.Minute, records: map[string]string{}, wait: waitForTXT}
+}
+
+// Type returns "dns-01"
+func (s *DNSSolver) Type() string {
+	return "dns-01"
+}
+
+// digest of the key authorization that goes in the TXT record
+func dnsChallengeValue(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return b64(sum[:])
+}
+
+// Present creates the TXT record and waits until the domain's nameservers
+// serve it. The record is deleted again if it doesn't propagate.
+func (s *DNSSolver) Present(domain, token, keyAuth string) error {
+	name := "_acme-challenge." + domain
+	value := dnsChallengeValue(keyAuth)
+
+	log.Printf("action: creating TXT record %q\n", name)
+	recordID, err := s.Provider.CreateTXTRecord(name, value)
+	if err != nil {
+		return fmt.Errorf("error: could not create TXT record: %q\n", err)
+	}
+	s.mu.Lock()
+	s.records[token] = recordID
+	s.mu.Unlock()
+
+	if err := s.wait(name, value, s.Timeout); err != nil {
+		if cleanErr := s.CleanUp(domain, token, keyAuth); cleanErr != nil {
+			log.Printf("error: could not delete TXT record %q: %q\n", name, cleanErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// CleanUp deletes the TXT record created for the token
+func (s *DNSSolver) CleanUp(domain, token, keyAuth string) error {
+	s.mu.Lock()
+	recordID, ok := s.records[token]
+	delete(s.records, token)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	log.Printf("action: deleting TXT record %q\n", "_acme-challenge."+domain)
+	return s.Provider.DeleteRecord(recordID)
+}
+
+// authoritativeNS finds the nameservers of the zone a name belongs to
+func authoritativeNS(name string) ([]string, error) {
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i := range labels[:len(labels)-1] {
+		records, err := net.LookupNS(strings.Join(labels[i:], "."))
+		if err != nil || len(records) == 0 {
+			continue
+		}
+		var servers []string
+		for _, ns := range records {
+			servers = append(servers, strings.TrimSuffix(ns.Host, "."))
+		}
+		return servers, nil
+	}
+	return nil, fmt.Errorf("error: could not find nameservers for %q", name)
+}
+
+// resolver that sends its queries straight to a nameserver
+func nameserverResolver(ns string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ns, "53"))
+		},
+	}
+}
+
+// hasTXT reports whether the resolver returns the value for the name
+func hasTXT(r *net.Resolver, name, value string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	records, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		return false
+	}
+	for _, record := range records {
+		if record == value {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForTXT polls the authoritative nameservers until all of them serve the
+// TXT record. Without known nameservers the system resolver is asked instead.
+func waitForTXT(name, value string, timeout time.Duration) error {
+	resolvers := []*net.Resolver{net.DefaultResolver}
+	if servers, err := authoritativeNS(name); err == nil {
+		resolvers = nil
+		for _, ns := range servers {
+			resolvers = append(resolvers, nameserverResolver(ns))
+		}
+	} else {
+		log.Println(err)
+	}
+
+	log.Printf("action: waiting for TXT record %q to propagate\n", name)
+	deadline := time.Now().Add(timeout)
+	for {
+		propagated := true
+		for _, r := range resolvers {
+			if !hasTXT(r, name, value) {
+				propagated = false
+				break
+			}
+		}
+		if propagated {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("error: TXT record %q did not propagate within %s\n", name, timeout)
+		}
+		<-time.After(5 * time.Second)
+	}
+}
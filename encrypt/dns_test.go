@@ -0,0 +1,75 @@
+package encrypt
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeDNS keeps TXT records in memory
+type fakeDNS struct {
+	records map[string]string
+	next    int
+}
+
+func (f *fakeDNS) CreateTXTRecord(name, content string) (string, error) {
+	f.next++
+	id := string(rune('a' + f.next))
+	f.records[id] = name + " " + content
+	return id, nil
+}
+
+func (f *fakeDNS) DeleteRecord(recordID string) error {
+	if _, ok := f.records[recordID]; !ok {
+		return errors.New("no such record")
+	}
+	delete(f.records, recordID)
+	return nil
+}
+
+func TestDNSSolver(t *testing.T) {
+	provider := &fakeDNS{records: map[string]string{}}
+	s := NewDNSSolver(provider)
+	var waitErr error
+	s.wait = func(name, value string, timeout time.Duration) error {
+		if want := "_acme-challenge.example.com"; name != want {
+			t.Errorf("waited for %q, want %q", name, want)
+		}
+		if value != dnsChallengeValue("token.key") {
+			t.Errorf("waited for value %q", value)
+		}
+		return waitErr
+	}
+
+	if err := s.Present("example.com", "token", "token.key"); err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.records) != 1 {
+		t.Fatalf("got %d records, want 1", len(provider.records))
+	}
+	if err := s.CleanUp("example.com", "token", "token.key"); err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.records) != 0 {
+		t.Fatalf("got %d records after clean up, want none", len(provider.records))
+	}
+
+	// records that don't propagate are not left behind
+	waitErr = errors.New("timed out")
+	if err := s.Present("example.com", "token", "token.key"); err != waitErr {
+		t.Fatalf("got %v, want %v", err, waitErr)
+	}
+	if len(provider.records) != 0 {
+		t.Errorf("got %d records after a failed present, want none", len(provider.records))
+	}
+	if err := s.CleanUp("example.com", "token", "token.key"); err != nil {
+		t.Errorf("clean up after a failed present: %v", err)
+	}
+}
+
+func TestDNSChallengeValue(t *testing.T) {
+	// base64url of the SHA-256 digest of an empty key authorization
+	if got := dnsChallengeValue(""); got != "47DEQpj8HBSa-_TImW-5JCeuQeRkm5NMpJWZG3hSuFU" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -3,57 +3,111 @@ package encrypt
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
-
-	"github.com/ericchiang/letsencrypt"
 )
 
 // Domain is the struct represntation of the domain to encrypt
 type Domain struct {
-	API          string
-	Domain       string
-	Challenge    letsencrypt.Challenge
-	Registration letsencrypt.Registration
-	AuthKey      *rsa.PrivateKey
-	client       *letsencrypt.Client
-	certificate  *x509.Certificate
+	API         string
+	Domain      string
+	AuthKey     *rsa.PrivateKey
+	Solver      Solver
+	HTTPClient  *http.Client
+	client      *acmeClient
+	certificate *x509.Certificate
+	keyPair     atomic.Value
+	// waits between renewals
+	after func(d time.Duration) <-chan time.Time
 }
 
-// NewDomain instantiates a new domain to be encrypted
+// NewDomain instantiates a new domain to be encrypted. An empty api uses
+// Let's Encrypt's production directory.
 func NewDomain(domain, api string) *Domain {
-	return &Domain{Domain: domain, API: api}
+	if api == "" {
+		api = LetsEncryptAPI
+	}
+	return &Domain{Domain: domain, API: api, Solver: NewHTTPSolver(), after: time.After}
+}
+
+// TrustCA adds the PEM encoded root certificates in the file to the ones
+// trusted when talking to the ACME server, e.g. for a local test server
+func (d *Domain) TrustCA(path string) error {
+	caBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error: could not read ca file: %q\n", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return fmt.Errorf("error: no certificates found in %q\n", path)
+	}
+	d.HTTPClient = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return nil
 }
 
-// Bootstrap goes through the acme certificate request process for the domain
+// Bootstrap goes through the acme certificate request process for the domain.
+// A certificate on disk that isn't due for renewal is served without
+// contacting the ACME server.
 func (d *Domain) Bootstrap() error {
 	log.Printf("action: beginning %q bootstrap\n", d.Domain)
 
-	var err error
-	// Create new let's encrypt client
-	if d.client == nil {
-		if d.client, err = letsencrypt.NewClient(d.API); err != nil {
-			return fmt.Errorf("error: could not create letsencrypt client: %q\n", err)
+	// if we already have a cert that isn't due for renewal, use it
+	log.Printf("action: attempting to read %q\n", d.Domain+".crt")
+	if certBytes, err := ioutil.ReadFile(d.Domain + ".crt"); err == nil {
+		if certPem, _ := pem.Decode(certBytes); certPem != nil {
+			log.Println("action: decoding certificate")
+			if cert, err := x509.ParseCertificate(certPem.Bytes); err == nil {
+				d.certificate = cert
+				if time.Now().Before(renewalTime(cert)) {
+					return d.loadKeyPair()
+				}
+				log.Printf("action: certificate expires %s: renewing now\n", cert.NotAfter)
+			}
+		}
+	}
+
+	// request for certificate
+	log.Println("action: requesting for new certificate")
+	if err := d.requestCertificate(); err != nil {
+		// an old certificate that hasn't expired yet is better than none
+		if d.certificate != nil && time.Now().Before(d.certificate.NotAfter) {
+			if loadErr := d.loadKeyPair(); loadErr == nil {
+				log.Println("action: serving the existing certificate until renewal succeeds")
+			}
 		}
+		return err
 	}
+	return d.loadKeyPair()
+}
 
+// register reads or creates the auth key and finds or creates its account
+func (d *Domain) register() error {
+	var err error
 	// see if we already have an auth key on disk
-	if authBytes, err := ioutil.ReadFile("auth.key"); err == nil {
-		log.Println("action: reading auth.key")
-		authBlock, _ := pem.Decode(authBytes)
-		if authBlock != nil {
-			log.Println("action: decoding auth.key")
-			d.AuthKey, err = x509.ParsePKCS1PrivateKey(authBlock.Bytes)
-			if err != nil {
-				log.Printf("error: found auth.key file: could not parse: %q\n", err)
+	if d.AuthKey == nil {
+		if authBytes, err := ioutil.ReadFile("auth.key"); err == nil {
+			log.Println("action: reading auth.key")
+			authBlock, _ := pem.Decode(authBytes)
+			if authBlock != nil {
+				log.Println("action: decoding auth.key")
+				d.AuthKey, err = x509.ParsePKCS1PrivateKey(authBlock.Bytes)
+				if err != nil {
+					log.Printf("error: found auth.key file: could not parse: %q\n", err)
+				}
 			}
 		}
 	}
@@ -61,39 +115,11 @@ func (d *Domain) Bootstrap() error {
 	// Try to create a new auth key if we don't have one
 	if d.AuthKey == nil {
 		log.Println("action: creating auth.key")
-		// generate new auth key
 		d.AuthKey, err = rsa.GenerateKey(rand.Reader, 2048)
 		if err != nil {
 			return fmt.Errorf("error: could not generate auth key: %q\n", err)
 		}
 
-		// register new auth key
-		log.Println("action: registering auth.key")
-		d.Registration, err = d.client.NewRegistration(d.AuthKey)
-		if err != nil {
-			return fmt.Errorf("error: key registration failed: %q\n", err)
-		}
-
-		// request for authorization over the domain using this authkey
-		log.Printf("action: requesting auth.key authorization over %q\n", d.Domain)
-		auth, _, err := d.client.NewAuthorization(d.AuthKey, "dns", d.Domain)
-		if err != nil {
-			return fmt.Errorf("error: could not request for authorization: %q\n", err)
-		}
-
-		// we want to complete the http-01 challenge
-		for _, challenge := range auth.Challenges {
-			if challenge.Type == "http-01" {
-				d.Challenge = challenge
-				break
-			}
-		}
-		// try to complete the challenge
-		log.Println("action: attempting authorization challenge")
-		if err := d.completeChallenge(); err != nil {
-			return err
-		}
-
 		// write auth key to file for later
 		authPem := pem.EncodeToMemory(&pem.Block{
 			Type:  "RSA AUTH KEY",
@@ -101,67 +127,126 @@ func (d *Domain) Bootstrap() error {
 		})
 
 		log.Println("action: writing auth.key to disk")
-		if err := ioutil.WriteFile("auth.key", authPem, 0644); err != nil {
-			return fmt.Errorf("error: could not write authkey.pem: %q\n", err)
+		if err := ioutil.WriteFile("auth.key", authPem, 0600); err != nil {
+			return fmt.Errorf("error: could not write auth.key: %q\n", err)
 		}
 	}
 
-	// if we already have a cert, refresh it
-	log.Printf("action: attempting to read %q\n", d.Domain+".crt")
-	if certBytes, err := ioutil.ReadFile(d.Domain + ".crt"); err == nil {
-		if certPem, _ := pem.Decode(certBytes); certPem != nil {
-			log.Println("action: decoding certificate")
-			if cert, err := x509.ParseCertificate(certPem.Bytes); err == nil {
-				d.certificate = cert
-				return nil
-				// log.Println("action: attempting certificate refresh")
-				// if err := d.refreshCertificate(); err == nil {
-				// 	return nil
-				// }
-			}
-		}
+	// Create new acme client and find or create the account for the auth key
+	if d.client == nil {
+		d.client = newACMEClient(d.API, d.AuthKey, d.HTTPClient)
 	}
-
-	// request for certificate
-	log.Println("action: requesting for new certificate")
-	if err := d.requestCertificate(); err != nil {
-		return err
+	if d.client.accountURL != "" {
+		return nil
+	}
+	log.Println("action: registering auth.key")
+	if err := d.client.register(); err != nil {
+		return fmt.Errorf("error: key registration failed: %q\n", err)
 	}
 	return nil
 }
 
-func (d *Domain) completeChallenge() error {
-	path, resource, err := d.Challenge.HTTP(d.AuthKey)
+// renewalTime is when a certificate should be renewed: after two thirds of
+// its lifetime
+func renewalTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * 2 / 3)
+}
+
+// loadKeyPair reads the certificate and its key from disk and swaps them in
+// for new TLS connections
+func (d *Domain) loadKeyPair() error {
+	keyPair, err := tls.LoadX509KeyPair(d.Domain+".crt", d.Domain+".key")
 	if err != nil {
-		return fmt.Errorf("error: could not complete challenge: %q\n", err)
+		return fmt.Errorf("error: could not load certificate key pair: %q\n", err)
 	}
+	d.keyPair.Store(&keyPair)
+	return nil
+}
 
-	l, err := net.Listen("tcp", ":80")
+// GetCertificate serves the current certificate to TLS clients. It's meant
+// for tls.Config.GetCertificate so that renewed certificates are picked up
+// without restarting the server. tls-alpn-01 validation requests get the
+// challenge certificate instead.
+func (d *Domain) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if solver, ok := d.Solver.(*TLSALPNSolver); ok && hello != nil && isACMETLS(hello) {
+		return solver.certificate(hello.ServerName)
+	}
+	keyPair, ok := d.keyPair.Load().(*tls.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("error: no certificate available for %q", d.Domain)
+	}
+	return keyPair, nil
+}
+
+// ChallengeHandler answers http-01 challenges when the domain uses an
+// HTTPSolver. It's meant to be mounted on ChallengePath.
+func (d *Domain) ChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	if solver, ok := d.Solver.(*HTTPSolver); ok {
+		solver.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// authorize completes the challenge of an authorization with the solver
+func (d *Domain) authorize(authzURL string) error {
+	authz, err := d.client.authorization(authzURL)
 	if err != nil {
-		return fmt.Errorf("error: could not create http listener for challenge: %q\n", err)
+		return fmt.Errorf("error: could not fetch authorization: %q\n", err)
+	}
+	if authz.Status == "valid" {
+		return nil
 	}
-	defer l.Close()
 
-	// Spin Up http server to handle the challenge
-	go func() {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path != path {
-				http.NotFound(w, r)
-				return
-			}
-			io.WriteString(w, resource)
-		})
-		http.Serve(l, mux)
+	var challenge *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == d.Solver.Type() {
+			challenge = &authz.Challenges[i]
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("error: no %s challenge offered for %q\n", d.Solver.Type(), authz.Identifier.Value)
+	}
+
+	log.Printf("action: attempting %s challenge for %q\n", challenge.Type, authz.Identifier.Value)
+	keyAuth := d.client.keyAuthorization(challenge.Token)
+	if err := d.Solver.Present(authz.Identifier.Value, challenge.Token, keyAuth); err != nil {
+		return fmt.Errorf("error: could not complete challenge: %q\n", err)
+	}
+	defer func() {
+		if err := d.Solver.CleanUp(authz.Identifier.Value, challenge.Token, keyAuth); err != nil {
+			log.Printf("error: could not clean up challenge: %q\n", err)
+		}
 	}()
 
-	if err = d.client.ChallengeReady(d.AuthKey, d.Challenge); err != nil {
+	if err := d.client.accept(challenge.URL); err != nil {
+		return fmt.Errorf("error: failed challenge: %q\n", err)
+	}
+	if err := d.client.waitAuthorization(authzURL); err != nil {
 		return fmt.Errorf("error: failed challenge: %q\n", err)
 	}
 	return nil
 }
 
 func (d *Domain) requestCertificate() error {
+	if err := d.register(); err != nil {
+		return err
+	}
+
+	// place an order for the domain and prove we control it
+	log.Printf("action: ordering certificate for %q\n", d.Domain)
+	order, err := d.client.newOrder(d.Domain)
+	if err != nil {
+		return fmt.Errorf("error: could not create order: %q\n", err)
+	}
+	for _, authzURL := range order.Authorizations {
+		if err := d.authorize(authzURL); err != nil {
+			return err
+		}
+	}
+
 	// create new certificate private key
 	log.Println("action: creating new cert key")
 	certKey, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -185,79 +270,85 @@ func (d *Domain) requestCertificate() error {
 		return fmt.Errorf("error: could not create CSR: %q\n", err)
 	}
 
-	// Save cert private key to file
+	log.Println("action: finalizing order")
+	order, err = d.client.finalize(order, csrDER)
+	if err != nil {
+		return fmt.Errorf("error: could not finalize order: %q\n", err)
+	}
+
+	log.Println("action: downloading certificate")
+	chainPem, err := d.client.certificate(order.Certificate)
+	if err != nil {
+		return fmt.Errorf("error: could not download certificate: %q\n", err)
+	}
+	certPem, _ := pem.Decode(chainPem)
+	if certPem == nil {
+		return fmt.Errorf("error: no certificate in response for %q\n", d.Domain)
+	}
+	cert, err := x509.ParseCertificate(certPem.Bytes)
+	if err != nil {
+		return fmt.Errorf("error: could not parse certifcate: %q\n", err)
+	}
+
+	// Save cert private key to file now that it has a certificate
 	keyPem := pem.EncodeToMemory(&pem.Block{
 		Type:  "RSA PRIVATE KEY",
 		Bytes: x509.MarshalPKCS1PrivateKey(certKey),
 	})
 
 	log.Println("action: saving cert private key")
-	if err := ioutil.WriteFile(d.Domain+".key", keyPem, 0644); err != nil {
+	if err := ioutil.WriteFile(d.Domain+".key", keyPem, 0600); err != nil {
 		return fmt.Errorf("error: could not write privatekey.pem: %q\n", err)
 	}
 
-	// request new certificate request with let's encrypt
-	csr, err := x509.ParseCertificateRequest(csrDER)
-	if err != nil {
-		return fmt.Errorf("error: could not parse csr: %q\n", err)
-	}
-
-	log.Println("action: requesting for new cert")
-	reg, err := d.client.NewCertificate(d.AuthKey, csr)
-	if err != nil {
-		return fmt.Errorf("error: could not request for a new certificate: %q\n", err)
-	}
-
-	// write new certificate to disk
+	// write the certificate and its chain to disk
 	log.Println("action: writing certificate to disk")
-	if err := d.persistCertificate(reg.Certificate); err != nil {
+	if err := ioutil.WriteFile(d.Domain+".crt", chainPem, 0644); err != nil {
 		return fmt.Errorf("error: could not create certificate pem: %q\n", err)
 	}
 
 	// save it in memory
-	cert, err := x509.ParseCertificate(reg.Certificate.Raw)
-	if err != nil {
-		return fmt.Errorf("error: could not parse certifcate: %q\n", err)
-	}
 	d.certificate = cert
 	return nil
 }
 
-// RefreshCertificate refreshes the certificate every 30 days
+// RefreshCertificate renews the certificate after two thirds of its lifetime,
+// retrying with an increasing delay when renewal fails
 func (d *Domain) RefreshCertificate() {
+	const minBackoff = time.Minute
+	const maxBackoff = 6 * time.Hour
+	backoff := minBackoff
+	// without a certificate the bootstrap just failed
+	retrying := d.certificate == nil
 	for {
-		<-time.After(time.Hour * 24 * 30)
-		err := d.refreshCertificate()
-		if err != nil {
-			log.Printf("error: could not renew certificate: %q\n", err)
+		wait := backoff
+		if !retrying {
+			wait = time.Until(renewalTime(d.certificate))
+		}
+		if wait > 0 {
+			log.Printf("action: renewing certificate in %s\n", wait)
+			<-d.after(wait)
 		}
-	}
-}
 
-// persist certificate to disk
-func (d *Domain) persistCertificate(cert *x509.Certificate) error {
-	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
-	if err := ioutil.WriteFile(d.Domain+".crt", certPem, 0644); err != nil {
-		return err
-	}
-	return nil
-}
+		// without any certificate we have to go through the whole bootstrap
+		var err error
+		if d.certificate == nil {
+			err = d.Bootstrap()
+		} else if err = d.requestCertificate(); err == nil {
+			err = d.loadKeyPair()
+		}
+		if err == nil && d.certificate != nil {
+			log.Printf("action: certificate renewed: expires %s\n", d.certificate.NotAfter)
+			backoff, retrying = minBackoff, false
+			continue
+		}
 
-func (d *Domain) refreshCertificate() error {
-	certResp, err := d.client.RenewCertificate("https://" + d.Domain)
-	if err != nil {
-		return err
-	}
-	// Renewal returned the same cert: we should request for a new one
-	if certResp.Certificate.Equal(d.certificate) {
-		if err := d.requestCertificate(); err != nil {
-			return err
+		if retrying {
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
 		}
-	} else {
-		// update in memory cert
-		d.certificate = certResp.Certificate
-		// save cert to disk
-		return d.persistCertificate(certResp.Certificate)
+		retrying = true
+		log.Printf("error: could not renew certificate: retrying in %s: %q\n", backoff, err)
 	}
-	return nil
 }
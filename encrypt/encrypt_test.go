@@ -0,0 +1,269 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshake with the domain's GetCertificate as a TLS client offering the
+// protocols and return the certificate it was served
+func handshake(t *testing.T, d *Domain, protos ...string) *x509.Certificate {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		tls.Server(server, &tls.Config{
+			GetCertificate: d.GetCertificate,
+			NextProtos:     []string{"http/1.1", ACMETLSProto},
+		}).Handshake()
+	}()
+	conn := tls.Client(client, &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         protos,
+		InsecureSkipVerify: true,
+	})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestGetCertificateSwap(t *testing.T) {
+	inTempDir(t)
+	stub := newACMEStub(t)
+	defer stub.server.Close()
+
+	d := NewDomain("example.com", stub.url("/directory"))
+	d.HTTPClient = stub.server.Client()
+	d.Solver = stub.solver
+	if _, err := d.GetCertificate(nil); err == nil {
+		t.Error("want an error before there is a certificate")
+	}
+	if err := d.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	first := handshake(t, d)
+	if !first.Equal(d.certificate) {
+		t.Error("not serving the bootstrapped certificate")
+	}
+
+	// new connections get the renewed certificate without a restart
+	if err := d.requestCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if again := handshake(t, d); !again.Equal(first) {
+		t.Error("switched certificates before the new one was loaded")
+	}
+	if err := d.loadKeyPair(); err != nil {
+		t.Fatal(err)
+	}
+	renewed := handshake(t, d)
+	if renewed.Equal(first) || !renewed.Equal(d.certificate) {
+		t.Errorf("serving serial %s after renewal, want %s", renewed.SerialNumber, d.certificate.SerialNumber)
+	}
+}
+
+// write a self-signed certificate for example.com valid between the times
+// and its key where Bootstrap looks for them
+func writeCertificate(t *testing.T, notBefore, notAfter time.Time) *x509.Certificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile("example.com.crt", certPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("example.com.key", keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// fakeClock hands every wait of RefreshCertificate to the test, which lets
+// it pass by closing fire
+type fakeClock struct {
+	waits chan fakeWait
+}
+
+type fakeWait struct {
+	d    time.Duration
+	fire chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{waits: make(chan fakeWait)}
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	w := fakeWait{d: d, fire: make(chan time.Time)}
+	c.waits <- w
+	return w.fire
+}
+
+// the next wait, failing the test if it doesn't come
+func (c *fakeClock) next(t *testing.T) fakeWait {
+	select {
+	case w := <-c.waits:
+		return w
+	case <-time.After(10 * time.Second):
+		t.Fatal("no wait")
+	}
+	return fakeWait{}
+}
+
+func TestRenewalTime(t *testing.T) {
+	issued := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		lifetime time.Duration
+		want     time.Time
+	}{
+		{90 * 24 * time.Hour, issued.AddDate(0, 0, 60)},
+		{6 * 24 * time.Hour, issued.AddDate(0, 0, 4)},
+		{3 * time.Hour, issued.Add(2 * time.Hour)},
+	}
+	for _, test := range tests {
+		cert := &x509.Certificate{NotBefore: issued, NotAfter: issued.Add(test.lifetime)}
+		if got := renewalTime(cert); !got.Equal(test.want) {
+			t.Errorf("lifetime %s: got %s, want %s", test.lifetime, got, test.want)
+		}
+	}
+}
+
+func TestBootstrapExpired(t *testing.T) {
+	inTempDir(t)
+	stub := newACMEStub(t)
+	defer stub.server.Close()
+	expired := writeCertificate(t, time.Now().Add(-100*24*time.Hour), time.Now().Add(-10*24*time.Hour))
+
+	d := NewDomain("example.com", stub.url("/directory"))
+	d.HTTPClient = stub.server.Client()
+	d.Solver = stub.solver
+	if err := d.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	if stub.orders != 1 {
+		t.Errorf("placed %d orders, want 1", stub.orders)
+	}
+	if served := handshake(t, d); served.Equal(expired) || !time.Now().Before(served.NotAfter) {
+		t.Errorf("serving a certificate that expired %s", served.NotAfter)
+	}
+}
+
+func TestBootstrapDue(t *testing.T) {
+	inTempDir(t)
+	stub := newACMEStub(t)
+	stub.server.Close()
+	// past two thirds of its lifetime but still valid
+	due := writeCertificate(t, time.Now().Add(-80*24*time.Hour), time.Now().Add(10*24*time.Hour))
+
+	d := NewDomain("example.com", stub.url("/directory"))
+	d.HTTPClient = stub.server.Client()
+	if err := d.Bootstrap(); err == nil {
+		t.Error("want the renewal error")
+	}
+	if served := handshake(t, d); !served.Equal(due) {
+		t.Error("not serving the certificate on disk while renewal fails")
+	}
+}
+
+func TestRefreshCertificate(t *testing.T) {
+	inTempDir(t)
+	stub := newACMEStub(t)
+	defer stub.server.Close()
+	clock := newFakeClock()
+
+	d := NewDomain("example.com", stub.url("/directory"))
+	d.HTTPClient = stub.server.Client()
+	d.Solver = stub.solver
+	d.after = clock.after
+	if err := d.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	first := d.certificate
+	go d.RefreshCertificate()
+
+	// renewal waits until two thirds of the certificate's lifetime
+	w := clock.next(t)
+	if want := time.Until(renewalTime(first)); w.d < want-time.Minute || w.d > want+time.Minute {
+		t.Errorf("waiting %s, want %s", w.d, want)
+	}
+	close(w.fire)
+
+	// then renews, serves the new certificate and waits for its renewal time
+	w = clock.next(t)
+	if stub.orders != 2 || d.certificate.Equal(first) {
+		t.Fatalf("got %d orders after the renewal, want 2", stub.orders)
+	}
+	if served := handshake(t, d); !served.Equal(d.certificate) {
+		t.Error("not serving the renewed certificate")
+	}
+	if want := time.Until(renewalTime(d.certificate)); w.d < want-time.Minute || w.d > want+time.Minute {
+		t.Errorf("waiting %s, want %s", w.d, want)
+	}
+}
+
+func TestRefreshCertificateBackoff(t *testing.T) {
+	want := []time.Duration{
+		time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute,
+		32 * time.Minute, 64 * time.Minute, 128 * time.Minute, 256 * time.Minute,
+		6 * time.Hour, 6 * time.Hour,
+	}
+	tests := []struct {
+		name        string
+		certificate bool
+	}{
+		{"no certificate", false},
+		{"certificate due for renewal", true},
+	}
+	for _, test := range tests {
+		inTempDir(t)
+		stub := newACMEStub(t)
+		stub.server.Close()
+		clock := newFakeClock()
+
+		d := NewDomain("example.com", stub.url("/directory"))
+		d.HTTPClient = stub.server.Client()
+		d.after = clock.after
+		if test.certificate {
+			writeCertificate(t, time.Now().Add(-80*24*time.Hour), time.Now().Add(10*24*time.Hour))
+		}
+		d.Bootstrap()
+		go d.RefreshCertificate()
+
+		for i, backoff := range want {
+			w := clock.next(t)
+			if w.d != backoff {
+				t.Errorf("%s: wait %d: got %s, want %s", test.name, i, w.d, backoff)
+			}
+			close(w.fire)
+		}
+		// leave the last retry waiting
+		clock.next(t)
+	}
+}
@@ -0,0 +1,74 @@
+package encrypt
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Solver proves control of the domain for one type of ACME challenge
+type Solver interface {
+	// Type is the challenge type solved, e.g. "http-01"
+	Type() string
+	// Present makes the key authorization for the token available for the
+	// ACME server to validate
+	Present(domain, token, keyAuth string) error
+	// CleanUp removes whatever Present set up
+	CleanUp(domain, token, keyAuth string) error
+}
+
+// ChallengePath is where http-01 challenges are requested. Mount
+// Domain.ChallengeHandler on it on the server listening on port 80.
+const ChallengePath = "/.well-known/acme-challenge/"
+
+// HTTPSolver solves http-01 challenges by serving the key authorizations
+// of its tokens under ChallengePath
+type HTTPSolver struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+// NewHTTPSolver creates an http-01 solver
+func NewHTTPSolver() *HTTPSolver {
+	return &HTTPSolver{tokens: map[string]string{}}
+}
+
+// Type returns "http-01"
+func (s *HTTPSolver) Type() string {
+	return "http-01"
+}
+
+// Present starts serving the key authorization for the token
+func (s *HTTPSolver) Present(domain, token, keyAuth string) error {
+	s.mu.Lock()
+	s.tokens[token] = keyAuth
+	s.mu.Unlock()
+	return nil
+}
+
+// CleanUp stops serving the token
+func (s *HTTPSolver) CleanUp(domain, token, keyAuth string) error {
+	s.mu.Lock()
+	delete(s.tokens, token)
+	s.mu.Unlock()
+	return nil
+}
+
+// ServeHTTP answers challenge requests for the registered tokens
+func (s *HTTPSolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	keyAuth, ok := s.tokens[strings.TrimPrefix(r.URL.Path, ChallengePath)]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, keyAuth)
+}
@@ -0,0 +1,61 @@
+package encrypt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChallengeHandler(t *testing.T) {
+	solver := NewHTTPSolver()
+	d := NewDomain("example.com", "")
+	d.Solver = solver
+	if err := solver.Present("example.com", "token", "token.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.Present("example.com", "done", "done.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+	if err := solver.CleanUp("example.com", "done", "done.thumbprint"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"GET", ChallengePath + "token", http.StatusOK, "token.thumbprint"},
+		{"HEAD", ChallengePath + "token", http.StatusOK, ""},
+		{"GET", ChallengePath + "unknown", http.StatusNotFound, ""},
+		{"GET", ChallengePath + "done", http.StatusNotFound, ""},
+		{"GET", ChallengePath, http.StatusNotFound, ""},
+		{"GET", ChallengePath + "token/", http.StatusNotFound, ""},
+		{"GET", ChallengePath + "../token", http.StatusNotFound, ""},
+		{"GET", ChallengePath + "x/../token", http.StatusNotFound, ""},
+		{"GET", ChallengePath + "../../../etc/passwd", http.StatusNotFound, ""},
+		{"GET", "/token", http.StatusNotFound, ""},
+		{"POST", ChallengePath + "token", http.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, "/", nil)
+		// keep the path as is: the client might not clean it
+		r.URL.Path = test.path
+		d.ChallengeHandler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.path, w.Code, test.code)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s %s: got %q, want %q", test.method, test.path, w.Body, test.body)
+		}
+	}
+
+	// other solvers don't answer http-01 challenges
+	d.Solver = NewTLSALPNSolver()
+	w := httptest.NewRecorder()
+	d.ChallengeHandler(w, httptest.NewRequest("GET", ChallengePath+"token", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("tls-alpn-01 solver: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,35 @@
+package filehelpers
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// WriteJSON writes data as indented JSON to a temporary file next to path and
+// renames it over path, so a crash mid-write never leaves a truncated file
+func WriteJSON(path string, data interface{}) error {
+	dataBytes, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := path + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(dataBytes); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, path)
+}
@@ -0,0 +1,48 @@
+package filehelpers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filehelpers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "data.json")
+
+	for _, want := range []map[string]int{{"a": 1}, {"b": 2}} {
+		if err := WriteJSON(path, want); err != nil {
+			t.Fatal(err)
+		}
+		dataBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]int)
+		if err := json.Unmarshal(dataBytes, &got); err != nil || len(got) != 1 || got["a"] != want["a"] || got["b"] != want["b"] {
+			t.Errorf("got %s, want %v", dataBytes, want)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// nothing is written when the data can't be encoded
+	if err := WriteJSON(path, func() {}); err == nil {
+		t.Error("want an encoding error")
+	}
+	if dataBytes, _ := ioutil.ReadFile(path); string(dataBytes) != "{\n  \"b\": 2\n}" {
+		t.Errorf("file changed to %s", dataBytes)
+	}
+
+	// a directory that doesn't exist
+	if err := WriteJSON(filepath.Join(dir, "missing", "data.json"), 1); err == nil {
+		t.Error("want an error for a missing directory")
+	}
+}
@@ -0,0 +1,117 @@
+package rf
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Bit orders supported by an Encoding
+const (
+	MSBFirst = "msb"
+	LSBFirst = "lsb"
+)
+
+// Encoding describes how a decimal code is turned into pilight raw pulses.
+// A 0 bit is sent as a short high followed by a long low, a 1 bit as a long
+// high followed by a short low and the train ends with a short high followed
+// by the footer. All durations are in microseconds.
+type Encoding struct {
+	Name     string `json:"name"`
+	Short    int    `json:"short"`
+	Long     int    `json:"long"`
+	Footer   int    `json:"footer"`
+	Bits     int    `json:"bits"`
+	BitOrder string `json:"bitOrder,omitempty"`
+}
+
+// Encoding presets for common cheap 433MHz outlets
+var (
+	Etekcity = Encoding{Name: "etekcity", Short: 174, Long: 522, Footer: 5916, Bits: 24, BitOrder: MSBFirst}
+	PT2262   = Encoding{Name: "pt2262", Short: 350, Long: 1050, Footer: 10850, Bits: 24, BitOrder: MSBFirst}
+	EV1527   = Encoding{Name: "ev1527", Short: 300, Long: 900, Footer: 9300, Bits: 24, BitOrder: MSBFirst}
+)
+
+var (
+	encodings = map[string]Encoding{
+		Etekcity.Name: Etekcity,
+		PT2262.Name:   PT2262,
+		EV1527.Name:   EV1527,
+	}
+	encodingsMu sync.RWMutex
+)
+
+// Validate makes sure the encoding can produce a pulse train
+func (e Encoding) Validate() error {
+	if strings.TrimSpace(e.Name) == "" {
+		return errors.New("error: encoding: missing name")
+	}
+	if e.Short <= 0 || e.Long <= 0 || e.Footer <= 0 {
+		return fmt.Errorf("error: encoding %q: pulse lengths must be positive", e.Name)
+	}
+	if e.Bits <= 0 || e.Bits > 62 {
+		return fmt.Errorf("error: encoding %q: bits must be between 1 and 62", e.Name)
+	}
+	if e.BitOrder != "" && e.BitOrder != MSBFirst && e.BitOrder != LSBFirst {
+		return fmt.Errorf("error: encoding %q: bit order must be %q or %q", e.Name, MSBFirst, LSBFirst)
+	}
+	return nil
+}
+
+// Fits reports whether the code can be represented in the encoding's bits.
+// The bound is computed in 64 bits so wide encodings work on 32-bit builds.
+func (e Encoding) Fits(code int) bool {
+	return code >= 0 && uint64(code) < uint64(1)<<uint(e.Bits)
+}
+
+// RegisterEncoding adds a custom encoding, or replaces one with the same name
+func RegisterEncoding(e Encoding) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	encodings[strings.ToLower(e.Name)] = e
+	return nil
+}
+
+// LookupEncoding finds an encoding by name. An empty name is the Etekcity preset.
+func LookupEncoding(name string) (Encoding, error) {
+	if name == "" {
+		return Etekcity, nil
+	}
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	e, ok := encodings[strings.ToLower(name)]
+	if !ok {
+		return Encoding{}, errors.New("error: unknown encoding: " + name)
+	}
+	return e, nil
+}
+
+// Convert a decimal representation of signal to pilight raw
+func decimalToRaw(n int, e Encoding) string {
+	rf0 := strconv.Itoa(e.Short) + " " + strconv.Itoa(e.Long)
+	rf1 := strconv.Itoa(e.Long) + " " + strconv.Itoa(e.Short)
+	rffoot := strconv.Itoa(e.Short) + " " + strconv.Itoa(e.Footer)
+	bin := make([]string, 0, e.Bits+1)
+
+	// least significant bit first
+	for i := 0; i < e.Bits; i++ {
+		if n%2 == 0 {
+			bin = append(bin, rf0)
+		} else {
+			bin = append(bin, rf1)
+		}
+		n = n / 2
+	}
+	if e.BitOrder != LSBFirst {
+		for i := 0; i < e.Bits/2; i++ {
+			bin[i], bin[e.Bits-1-i] = bin[e.Bits-1-i], bin[i]
+		}
+	}
+	bin = append(bin, rffoot)
+	return strings.Join(bin, " ")
+}
@@ -0,0 +1,68 @@
+package rf
+
+import (
+	"testing"
+)
+
+func TestFits(t *testing.T) {
+	wide := Encoding{Name: "wide", Short: 100, Long: 300, Footer: 3000, Bits: 62}
+	tests := []struct {
+		encoding Encoding
+		code     int
+		fits     bool
+	}{
+		{Etekcity, 0, true},
+		{Etekcity, 1<<24 - 1, true},
+		{Etekcity, 1 << 24, false},
+		{Etekcity, -1, false},
+		{Encoding{Name: "short", Bits: 4}, 15, true},
+		{Encoding{Name: "short", Bits: 4}, 16, false},
+		{Encoding{Name: "32", Bits: 32}, 1<<31 - 1, true},
+		{wide, 1<<31 - 1, true},
+	}
+	for _, test := range tests {
+		if got := test.encoding.Fits(test.code); got != test.fits {
+			t.Errorf("%s (%d bits) fits %d: got %v, want %v", test.encoding.Name, test.encoding.Bits, test.code, got, test.fits)
+		}
+	}
+}
+
+func TestValidateEncoding(t *testing.T) {
+	tests := []struct {
+		encoding Encoding
+		ok       bool
+	}{
+		{Etekcity, true},
+		{Encoding{Name: "lsb", Short: 1, Long: 2, Footer: 3, Bits: 62, BitOrder: LSBFirst}, true},
+		{Encoding{Short: 1, Long: 2, Footer: 3, Bits: 24}, false},
+		{Encoding{Name: "zero", Long: 2, Footer: 3, Bits: 24}, false},
+		{Encoding{Name: "bits", Short: 1, Long: 2, Footer: 3, Bits: 63}, false},
+		{Encoding{Name: "order", Short: 1, Long: 2, Footer: 3, Bits: 24, BitOrder: "middle"}, false},
+	}
+	for _, test := range tests {
+		if err := test.encoding.Validate(); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v, want ok %v", test.encoding, err, test.ok)
+		}
+	}
+}
+
+func TestDecimalToRaw(t *testing.T) {
+	tests := []struct {
+		code     int
+		encoding Encoding
+		raw      string
+	}{
+		{5, Encoding{Short: 1, Long: 3, Footer: 9, Bits: 4, BitOrder: MSBFirst}, "1 3 3 1 1 3 3 1 1 9"},
+		{5, Encoding{Short: 1, Long: 3, Footer: 9, Bits: 4, BitOrder: LSBFirst}, "3 1 1 3 3 1 1 3 1 9"},
+		{1, Encoding{Short: 1, Long: 3, Footer: 9, Bits: 3}, "1 3 1 3 3 1 1 9"},
+	}
+	for _, test := range tests {
+		if raw := decimalToRaw(test.code, test.encoding); raw != test.raw {
+			t.Errorf("%d: got %q, want %q", test.code, raw, test.raw)
+		}
+		pulses, _ := parsePulses(test.raw)
+		if code, _, ok := rawToDecimal(pulses, test.encoding); !ok || code != test.code {
+			t.Errorf("%q: decoded %d, %v", test.raw, code, ok)
+		}
+	}
+}
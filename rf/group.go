@@ -0,0 +1,247 @@
+package rf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homeautomation/apihelpers"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AllGroup is the name of the group that always contains every switch
+const AllGroup = "all"
+
+var (
+	groups   = make(map[string][]string)
+	groupsMu sync.RWMutex
+)
+
+// SetGroups validates and installs the named groups of switches. Members
+// reference switches by index or by name. Besides these groups, "all"
+// contains every switch and every room is a group of its switches.
+func SetGroups(g map[string][]string) error {
+	rooms := make(map[string]bool)
+	for _, s := range Switches() {
+		rooms[roomKey(s)] = true
+	}
+	installed := make(map[string][]string, len(g))
+	for name, members := range g {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if key == "" {
+			return errors.New("error: group: missing name")
+		}
+		if key == AllGroup {
+			return fmt.Errorf("error: group %q is reserved", name)
+		}
+		if _, _, err := FindSwitch(name); err == nil {
+			return fmt.Errorf("error: group %q has the same name as a switch", name)
+		}
+		if rooms[key] {
+			return fmt.Errorf("error: group %q has the same name as a room", name)
+		}
+		if len(members) == 0 {
+			return fmt.Errorf("error: group %q has no switches", name)
+		}
+		for _, member := range members {
+			if _, _, err := FindSwitch(member); err != nil {
+				return fmt.Errorf("error: group %q: %v", name, err)
+			}
+		}
+		installed[key] = members
+	}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	groups = installed
+	return nil
+}
+
+// isGroup reports whether a group with the lowercase name is configured
+func isGroup(key string) bool {
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	_, ok := groups[key]
+	return ok
+}
+
+// the group name of a switch's room, "" when it has none
+func roomKey(s Switch) string {
+	return strings.ToLower(strings.TrimSpace(s.Room))
+}
+
+// Groups returns every group and the names of its switches
+func Groups() map[string][]string {
+	all := Switches()
+	result := make(map[string][]string)
+	for _, s := range all {
+		result[AllGroup] = append(result[AllGroup], s.Name)
+		if room := roomKey(s); room != "" {
+			result[room] = append(result[room], s.Name)
+		}
+	}
+	groupsMu.RLock()
+	defer groupsMu.RUnlock()
+	for name, members := range groups {
+		result[name] = nil
+		for _, member := range members {
+			if _, s, err := FindSwitch(member); err == nil {
+				result[name] = append(result[name], s.Name)
+			}
+		}
+	}
+	return result
+}
+
+// FindGroup returns the switches in a group
+func FindGroup(name string) ([]Switch, error) {
+	members, ok := Groups()[strings.ToLower(strings.TrimSpace(name))]
+	if !ok || len(members) == 0 {
+		return nil, errors.New("error: unknown group: " + name)
+	}
+	switches := make([]Switch, 0, len(members))
+	for _, member := range members {
+		if _, s, err := FindSwitch(member); err == nil {
+			switches = append(switches, s)
+		}
+	}
+	return switches, nil
+}
+
+// groupJobs creates the queue jobs that set every switch in a group and
+// cancels the pending timers of those switches
+func groupJobs(name, state string) ([]*queueJob, error) {
+	members, err := FindGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*queueJob, 0, len(members))
+	for _, s := range members {
+		job, err := switchJob(s.Name, state)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	for _, job := range jobs {
+		cancelTimers(job.sw.Name)
+	}
+	return jobs, nil
+}
+
+// SetGroup sets every switch in a group to the desired on/off/toggle state
+// and waits for all codes to be sent
+func SetGroup(name, state string) error {
+	jobs, err := groupJobs(name, state)
+	if err != nil {
+		return err
+	}
+	q := getQueue()
+	results := make([]<-chan error, len(jobs))
+	for i, job := range jobs {
+		results[i] = q.submit(job)
+	}
+	var failures []string
+	for i, result := range results {
+		if err := <-result; err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", jobs[i].sw.Name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("error: could not set switches: " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// SetGroupAsync queues the codes for every switch in a group without
+// waiting for them to be sent. Send failures are logged.
+func SetGroupAsync(name, state string) error {
+	jobs, err := groupJobs(name, state)
+	if err != nil {
+		return err
+	}
+	q := getQueue()
+	for _, job := range jobs {
+		q.enqueue(job)
+	}
+	return nil
+}
+
+// group and the states of its switches
+type groupState struct {
+	Name     string        `json:"name"`
+	Switches []SwitchState `json:"switches"`
+}
+
+// GroupHandler is an HTTP Handler that turns every switch in a group on or off.
+// A GET lists the groups and the states of their switches. Setting a state
+// takes a POST or PUT.
+// Query Params or JSON Body Supported:
+// state (string): "on | off | toggle"
+// group (string): name of the group
+func GroupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodPut {
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodPut)
+		return
+	}
+	request := struct {
+		Group string `json:"group"`
+		State string `json:"state"`
+	}{
+		Group: r.URL.Query().Get("group"),
+		State: r.URL.Query().Get("state"),
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid JSON Body")
+			return
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		if request.State != "" {
+			apihelpers.EncodeMethodNotAllowed(w, http.MethodPost, http.MethodPut)
+			return
+		}
+		all := Groups()
+		names := make([]string, 0, len(all))
+		for name := range all {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		result := make([]groupState, 0, len(names))
+		for _, name := range names {
+			g := groupState{Name: name, Switches: []SwitchState{}}
+			for _, member := range all[name] {
+				if state, err := GetState(member); err == nil {
+					g.Switches = append(g.Switches, state)
+				}
+			}
+			result = append(result, g)
+		}
+		apihelpers.EncodeJSON(w, http.StatusOK, result)
+		return
+	}
+
+	if request.Group == "" || request.State == "" {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Missing Group or State")
+		return
+	}
+	if _, err := FindGroup(request.Group); err != nil {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid Group")
+		return
+	}
+	state := strings.ToLower(request.State)
+	if !ValidState(state) {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid State: must be \"on\", \"off\" or \"toggle\"")
+		return
+	}
+
+	if err := SetGroup(request.Group, state); err != nil {
+		apihelpers.EncodeError(w, http.StatusInternalServerError, "Unable to send RF Code: "+err.Error())
+		return
+	}
+	success := fmt.Sprintf("Successfully turned group %s %s", request.Group, state)
+	apihelpers.EncodeJSON(w, http.StatusOK, map[string]string{"message": success})
+}
@@ -0,0 +1,201 @@
+package rf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homeautomation/apihelpers"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLearning is returned when a learn is requested while another one is running
+var ErrLearning = errors.New("error: already learning a switch")
+
+// ErrLearnTimeout is returned when no on/off pair was received in time
+var ErrLearnTimeout = errors.New("error: timed out waiting for remote")
+
+// ErrNoReceiver is returned when learning without a running receiver
+var ErrNoReceiver = errors.New("error: no rf receiver running")
+
+var (
+	learning   bool
+	learningMu sync.Mutex
+	saveHook   func([]Switch) error
+	saveHookMu sync.Mutex
+)
+
+// SetSaveHook sets the function used to persist the switches after a new
+// one has been learned
+func SetSaveHook(f func([]Switch) error) {
+	saveHookMu.Lock()
+	defer saveHookMu.Unlock()
+	saveHook = f
+}
+
+// Learn waits for the next on/off pair from a physical remote: the first
+// code received is taken as "on" and the next different code as "off". Both
+// are decoded with the same encoding.
+func Learn(timeout time.Duration) (on, off Received, err error) {
+	if !Receiving() {
+		return on, off, ErrNoReceiver
+	}
+	learningMu.Lock()
+	if learning {
+		learningMu.Unlock()
+		return on, off, ErrLearning
+	}
+	learning = true
+	learningMu.Unlock()
+	defer func() {
+		learningMu.Lock()
+		learning = false
+		learningMu.Unlock()
+	}()
+
+	codes := make(chan Received, 16)
+	remove := addListener(func(r Received) {
+		select {
+		case codes <- r:
+		default:
+		}
+	})
+	defer remove()
+
+	deadline := time.After(timeout)
+	var gotOn bool
+	for {
+		select {
+		case r := <-codes:
+			if !gotOn {
+				on, gotOn = r, true
+				continue
+			}
+			// remotes repeat codes: wait for the next different one
+			if r.Code != on.Code {
+				on, off = commonEncoding(on, r)
+				return on, off, nil
+			}
+		case <-deadline:
+			return on, off, ErrLearnTimeout
+		}
+	}
+}
+
+// commonEncoding decodes an on/off pair with the same encoding: the closest
+// fit of the on code that the off code fits as well. Timings of some
+// encodings are close enough for a train to fit several of them.
+func commonEncoding(on, off Received) (Received, Received) {
+	for _, candidate := range append([]Received{on}, on.Alternatives...) {
+		if code, ok := off.As(candidate.Encoding); ok {
+			candidate.Alternatives = nil
+			return candidate, Received{Code: code, Encoding: candidate.Encoding, Time: off.Time}
+		}
+	}
+	return on, off
+}
+
+// validateNewSwitch makes sure a switch can be added to the configured ones
+func validateNewSwitch(s Switch) error {
+	return ValidateSwitches(append(Switches(), s))
+}
+
+// AddSwitch adds a new switch to the configured switches and persists them
+func AddSwitch(s Switch) error {
+	if err := validateNewSwitch(s); err != nil {
+		return err
+	}
+	if err := SetSwitches(append(Switches(), s)); err != nil {
+		return err
+	}
+	saveHookMu.Lock()
+	defer saveHookMu.Unlock()
+	if saveHook == nil {
+		return nil
+	}
+	return saveHook(Switches())
+}
+
+// LearnHandler is an HTTP Handler that learns a new switch from its remote.
+// Press "on" and then "off" on the remote after calling it.
+// Body (JSON) or Query Params Supported:
+// name (string): name of the new switch
+// room (string): optional room of the new switch
+// timeout (string): how long to wait for the remote, e.g. "30s"
+func LearnHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	request := struct {
+		Name    string `json:"name"`
+		Room    string `json:"room"`
+		Timeout string `json:"timeout"`
+	}{
+		Name:    r.URL.Query().Get("name"),
+		Room:    r.URL.Query().Get("room"),
+		Timeout: r.URL.Query().Get("timeout"),
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid JSON Body")
+			return
+		}
+	}
+	if strings.TrimSpace(request.Name) == "" {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Missing Switch Name")
+		return
+	}
+	if _, _, err := FindSwitch(request.Name); err == nil {
+		apihelpers.EncodeError(w, http.StatusConflict, "Switch Already Exists")
+		return
+	}
+	// check the name before the remote is pressed, with stand-in codes
+	if err := validateNewSwitch(Switch{Name: request.Name, Room: request.Room, On: 1, Off: 2}); err != nil {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid Switch: "+err.Error())
+		return
+	}
+	timeout := 30 * time.Second
+	if request.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(request.Timeout); err != nil || timeout <= 0 {
+			apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid Timeout")
+			return
+		}
+	}
+	if !Receiving() {
+		apihelpers.EncodeError(w, http.StatusServiceUnavailable, "No RF Receiver Configured")
+		return
+	}
+
+	on, off, err := Learn(timeout)
+	switch err {
+	case nil:
+	case ErrNoReceiver:
+		apihelpers.EncodeError(w, http.StatusServiceUnavailable, "No RF Receiver Configured")
+		return
+	case ErrLearning:
+		apihelpers.EncodeError(w, http.StatusConflict, "Already Learning a Switch")
+		return
+	case ErrLearnTimeout:
+		apihelpers.EncodeError(w, http.StatusRequestTimeout, "Timed Out Waiting for Remote")
+		return
+	default:
+		apihelpers.EncodeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s := Switch{Name: request.Name, On: on.Code, Off: off.Code, Room: request.Room}
+	if on.Encoding != Etekcity.Name {
+		s.Encoding = on.Encoding
+	}
+	if err := AddSwitch(s); err != nil {
+		apihelpers.EncodeError(w, http.StatusInternalServerError, "Unable to Save Switch: "+err.Error())
+		return
+	}
+	success := fmt.Sprintf("Successfully learned switch %s", s.Name)
+	apihelpers.EncodeJSON(w, http.StatusOK, map[string]interface{}{"message": success, "switch": s})
+}
@@ -0,0 +1,112 @@
+package rf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pretend a receiver is running while f runs
+func withReceiver(f func()) {
+	atomic.AddInt32(&receiving, 1)
+	defer atomic.AddInt32(&receiving, -1)
+	f()
+}
+
+func learnRequest(query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	LearnHandler(w, httptest.NewRequest("POST", "/api/switch/learn?"+query, nil))
+	return w
+}
+
+func TestLearnHandlerValidation(t *testing.T) {
+	if err := SetSwitches([]Switch{{Name: "porch", On: 1, Off: 2, Room: "garden"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetGroups(map[string][]string{"outside": {"porch"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetGroups(nil)
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"name=", http.StatusBadRequest},
+		{"name=porch", http.StatusConflict},
+		{"name=42", http.StatusBadRequest},
+		{"name=garden", http.StatusBadRequest},
+		{"name=outside", http.StatusBadRequest},
+		{"name=all", http.StatusBadRequest},
+		{"name=lamp&timeout=never", http.StatusBadRequest},
+		{"name=lamp", http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		start := time.Now()
+		w := learnRequest(test.query)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d, want %d: %s", test.query, w.Code, test.code, w.Body)
+		}
+		if time.Since(start) > time.Second {
+			t.Errorf("%s: waited for the remote", test.query)
+		}
+	}
+}
+
+func TestLearn(t *testing.T) {
+	if err := SetSwitches(nil); err != nil {
+		t.Fatal(err)
+	}
+	var saved []Switch
+	SetSaveHook(func(s []Switch) error {
+		saved = s
+		return nil
+	})
+	defer SetSaveHook(nil)
+
+	var w *httptest.ResponseRecorder
+	withReceiver(func() {
+		done := make(chan bool)
+		go func() {
+			w = learnRequest("name=lamp&room=den&timeout=5s")
+			close(done)
+		}()
+		// press on, then off, until the handler has both
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				for _, code := range []int{1398067, 1398076} {
+					for _, r := range roundTrip(t, code, PT2262) {
+						dispatch(r)
+					}
+				}
+			}
+		}
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	want := Switch{Name: "lamp", Room: "den", On: 1398067, Off: 1398076, Encoding: PT2262.Name}
+	if len(saved) != 1 || saved[0] != want {
+		t.Errorf("saved %+v, want %+v", saved, want)
+	}
+}
+
+func TestLearnWithoutReceiver(t *testing.T) {
+	if _, _, err := Learn(time.Second); err != ErrNoReceiver {
+		t.Errorf("got %v, want %v", err, ErrNoReceiver)
+	}
+}
+
+func TestCommonEncoding(t *testing.T) {
+	on := Received{Code: 1, Encoding: EV1527.Name, Alternatives: []Received{{Code: 1, Encoding: PT2262.Name}}}
+	off := Received{Code: 2, Encoding: PT2262.Name}
+	on, off = commonEncoding(on, off)
+	if on.Encoding != PT2262.Name || off.Encoding != PT2262.Name || on.Code != 1 || off.Code != 2 {
+		t.Errorf("got %+v and %+v, want both pt2262", on, off)
+	}
+}
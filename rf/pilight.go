@@ -0,0 +1,195 @@
+package rf
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PilightError is a failure reported by the pilight daemon itself
+type PilightError struct {
+	Action  string
+	Message string
+}
+
+func (e *PilightError) Error() string {
+	return fmt.Sprintf("pilight %s failed: %s", e.Action, e.Message)
+}
+
+// pilight daemon status response
+type pilightStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// PilightClient speaks the pilight daemon's socket protocol over a
+// persistent connection. The connection is established lazily, kept alive
+// with heartbeats and re-established whenever it breaks.
+type PilightClient struct {
+	Address   string
+	Timeout   time.Duration
+	Heartbeat time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewPilightClient creates a client for the daemon at address (host:port)
+// and starts its heartbeat
+func NewPilightClient(address string) *PilightClient {
+	p := &PilightClient{
+		Address:   address,
+		Timeout:   5 * time.Second,
+		Heartbeat: 30 * time.Second,
+		done:      make(chan struct{}),
+	}
+	go p.heartbeat()
+	return p
+}
+
+// Transmit asks the daemon to send the code. Connection problems are retried
+// once on a fresh connection; failures reported by the daemon are returned
+// as a *PilightError.
+func (p *PilightClient) Transmit(protocol, code string) error {
+	send := map[string]interface{}{
+		"action": "send",
+		"code": map[string]interface{}{
+			"protocol": []string{protocol},
+			"code":     code,
+		},
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = p.connect(); err != nil {
+			continue
+		}
+		err = p.request("send", send)
+		if _, ok := err.(*PilightError); ok || err == nil {
+			return err
+		}
+		// the connection is broken: start over with a new one
+		log.Printf("error: pilight connection lost: %q\n", err)
+		p.disconnect()
+	}
+	return fmt.Errorf("error: could not reach pilight daemon at %s: %v", p.Address, err)
+}
+
+// Close shuts down the heartbeat and the connection to the daemon
+func (p *PilightClient) Close() error {
+	p.once.Do(func() { close(p.done) })
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.disconnect()
+	return nil
+}
+
+// dial the daemon and identify ourselves. Callers must hold p.mu
+func (p *PilightClient) connect() error {
+	if p.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", p.Address, p.Timeout)
+	if err != nil {
+		return err
+	}
+	p.conn = conn
+	p.reader = bufio.NewReader(conn)
+
+	identify := map[string]interface{}{
+		"action": "identify",
+		"options": map[string]int{
+			"core": 0, "receiver": 0, "config": 0, "forward": 0,
+		},
+	}
+	if err := p.request("identify", identify); err != nil {
+		p.disconnect()
+		return err
+	}
+	return nil
+}
+
+// drop the current connection. Callers must hold p.mu
+func (p *PilightClient) disconnect() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn = nil
+	p.reader = nil
+}
+
+// write a message to the daemon and wait for its status response.
+// Callers must hold p.mu
+func (p *PilightClient) request(action string, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	line, err := p.roundTrip(append(payload, '\n'))
+	if err != nil {
+		return err
+	}
+	status := pilightStatus{}
+	if err := json.Unmarshal(line, &status); err != nil {
+		return fmt.Errorf("could not decode pilight response %q: %v", line, err)
+	}
+	if status.Status != "success" {
+		reason := status.Message
+		if reason == "" {
+			reason = "daemon responded with status " + status.Status
+		}
+		return &PilightError{Action: action, Message: reason}
+	}
+	return nil
+}
+
+// write a raw payload and read back a single line. Callers must hold p.mu
+func (p *PilightClient) roundTrip(payload []byte) ([]byte, error) {
+	p.conn.SetDeadline(time.Now().Add(p.Timeout))
+	defer p.conn.SetDeadline(time.Time{})
+	if _, err := p.conn.Write(payload); err != nil {
+		return nil, err
+	}
+	line, err := p.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+// keep the connection alive: pilight answers "HEART" with "BEAT"
+func (p *PilightClient) heartbeat() {
+	ticker := time.NewTicker(p.Heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		if p.conn != nil {
+			line, err := p.roundTrip([]byte("HEART\n"))
+			if err == nil && strings.TrimSpace(string(line)) != "BEAT" {
+				err = errors.New("unexpected heartbeat response: " + string(line))
+			}
+			if err != nil {
+				log.Printf("error: pilight heartbeat failed: %q\n", err)
+				p.disconnect()
+			}
+		}
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,210 @@
+package rf
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePilight is a pilight daemon that accepts everything except the
+// "broken" protocol, and can drop a connection instead of answering
+type fakePilight struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	sent     []string
+	beats    int
+	accepted int
+	drop     bool
+}
+
+func newFakePilight(t *testing.T) *fakePilight {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePilight{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.accepted++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakePilight) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if strings.TrimSpace(line) == "HEART" {
+			f.mu.Lock()
+			f.beats++
+			f.mu.Unlock()
+			conn.Write([]byte("BEAT\n"))
+			continue
+		}
+
+		var message struct {
+			Action string `json:"action"`
+			Code   struct {
+				Protocol []string `json:"protocol"`
+				Code     string   `json:"code"`
+			} `json:"code"`
+		}
+		if err := json.Unmarshal([]byte(line), &message); err != nil {
+			conn.Write([]byte(`{"status":"failure","message":"bad json"}` + "\n"))
+			continue
+		}
+		if message.Action == "identify" {
+			conn.Write([]byte(`{"status":"success"}` + "\n"))
+			continue
+		}
+
+		f.mu.Lock()
+		drop := f.drop
+		f.drop = false
+		if !drop && message.Action == "send" && len(message.Code.Protocol) == 1 && message.Code.Protocol[0] != "broken" {
+			f.sent = append(f.sent, message.Code.Protocol[0]+" "+message.Code.Code)
+		}
+		f.mu.Unlock()
+		switch {
+		case drop:
+			return
+		case message.Action != "send" || len(message.Code.Protocol) != 1:
+			conn.Write([]byte(`{"status":"failure","message":"bad request"}` + "\n"))
+		case message.Code.Protocol[0] == "broken":
+			conn.Write([]byte(`{"status":"failure","message":"unknown protocol"}` + "\n"))
+		default:
+			conn.Write([]byte(`{"status":"success"}` + "\n"))
+		}
+	}
+}
+
+func (f *fakePilight) state() ([]string, int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent...), f.beats, f.accepted
+}
+
+func TestPilightTransmit(t *testing.T) {
+	daemon := newFakePilight(t)
+	defer daemon.listener.Close()
+	p := NewPilightClient(daemon.listener.Addr().String())
+	defer p.Close()
+
+	tests := []struct {
+		protocol, code string
+		daemonErr      bool
+	}{
+		{"raw", "300 900 300 9300", false},
+		{"arctech_switch", "12", false},
+		{"broken", "12", true},
+		{"raw", "300 9300", false},
+	}
+	for _, test := range tests {
+		err := p.Transmit(test.protocol, test.code)
+		if _, ok := err.(*PilightError); ok != test.daemonErr || (err != nil && !test.daemonErr) {
+			t.Errorf("%s %q: got error %v", test.protocol, test.code, err)
+		}
+	}
+
+	sent, _, accepted := daemon.state()
+	want := []string{"raw 300 900 300 9300", "arctech_switch 12", "raw 300 9300"}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Errorf("daemon got %q, want %q", sent, want)
+	}
+	if accepted != 1 {
+		t.Errorf("made %d connections, want 1", accepted)
+	}
+}
+
+func TestPilightReconnect(t *testing.T) {
+	daemon := newFakePilight(t)
+	defer daemon.listener.Close()
+	p := NewPilightClient(daemon.listener.Addr().String())
+	defer p.Close()
+
+	if err := p.Transmit("raw", "1"); err != nil {
+		t.Fatal(err)
+	}
+	daemon.mu.Lock()
+	daemon.drop = true
+	daemon.mu.Unlock()
+	if err := p.Transmit("raw", "2"); err != nil {
+		t.Fatalf("transmit after a dropped connection: %v", err)
+	}
+
+	sent, _, accepted := daemon.state()
+	if strings.Join(sent, "|") != "raw 1|raw 2" {
+		t.Errorf("daemon got %q", sent)
+	}
+	if accepted != 2 {
+		t.Errorf("made %d connections, want 2", accepted)
+	}
+}
+
+func TestPilightUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	p := NewPilightClient(address)
+	defer p.Close()
+	err = p.Transmit("raw", "1")
+	if _, ok := err.(*PilightError); err == nil || ok {
+		t.Errorf("got %v, want a connection error", err)
+	}
+}
+
+func TestPilightHeartbeat(t *testing.T) {
+	daemon := newFakePilight(t)
+	defer daemon.listener.Close()
+	p := &PilightClient{
+		Address:   daemon.listener.Addr().String(),
+		Timeout:   time.Second,
+		Heartbeat: 10 * time.Millisecond,
+		done:      make(chan struct{}),
+	}
+	go p.heartbeat()
+	defer p.Close()
+
+	if err := p.Transmit("raw", "1"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, beats, _ := daemon.state(); beats >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no heartbeats sent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the connection is still usable after the heartbeats
+	if err := p.Transmit("raw", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, accepted := daemon.state(); accepted != 1 {
+		t.Errorf("made %d connections, want 1", accepted)
+	}
+}
@@ -0,0 +1,181 @@
+package rf
+
+import (
+	"errors"
+	"fmt"
+	"homeautomation/apihelpers"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrQueueClosed is returned for codes submitted to a closed queue
+var ErrQueueClosed = errors.New("error: transmit queue is closed")
+
+// QueueConfig controls the transmit queue
+// Size (int): how many codes can be waiting before callers block
+// AirGap (int): minimum milliseconds of silence between two transmissions
+type QueueConfig struct {
+	Size   int `json:"size"`
+	AirGap int `json:"airGap"`
+}
+
+// a code waiting to be transmitted. Toggles are resolved into a code only
+// once it's their turn so that queued toggles build on each other.
+type queueJob struct {
+	sw     Switch
+	code   int
+	toggle bool
+	result chan error
+}
+
+// Queue serializes all transmissions through a single goroutine so that
+// concurrent requests never collide on air
+type Queue struct {
+	airGap  time.Duration
+	jobs    chan *queueJob
+	mu      sync.RWMutex
+	closed  bool
+	depth   int
+	depthMu sync.Mutex
+}
+
+// NewQueue creates a queue and starts its transmit goroutine
+func NewQueue(c QueueConfig) *Queue {
+	if c.Size <= 0 {
+		c.Size = 64
+	}
+	q := &Queue{
+		airGap: time.Duration(c.AirGap) * time.Millisecond,
+		jobs:   make(chan *queueJob, c.Size),
+	}
+	go q.run()
+	return q
+}
+
+// Submit queues a code and returns a channel that receives the result
+// once the code has been transmitted
+func (q *Queue) Submit(s Switch, code int) <-chan error {
+	return q.submit(&queueJob{sw: s, code: code})
+}
+
+func (q *Queue) submit(job *queueJob) <-chan error {
+	job.result = make(chan error, 1)
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		job.result <- ErrQueueClosed
+		return job.result
+	}
+	q.addDepth(1)
+	q.jobs <- job
+	return job.result
+}
+
+// Send queues a code and waits for it to be transmitted
+func (q *Queue) Send(s Switch, code int) error {
+	return <-q.Submit(s, code)
+}
+
+// Enqueue queues a code without waiting for it. Failures are logged.
+func (q *Queue) Enqueue(s Switch, code int) {
+	q.enqueue(&queueJob{sw: s, code: code})
+}
+
+func (q *Queue) enqueue(job *queueJob) {
+	result := q.submit(job)
+	go func() {
+		if err := <-result; err != nil {
+			log.Printf("error: could not send code for switch %q: %q\n", job.sw.Name, err)
+		}
+	}()
+}
+
+// Len is the number of codes waiting to be transmitted, including the one on air
+func (q *Queue) Len() int {
+	q.depthMu.Lock()
+	defer q.depthMu.Unlock()
+	return q.depth
+}
+
+// Close stops accepting codes. Codes already queued are still transmitted.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+}
+
+func (q *Queue) addDepth(n int) {
+	q.depthMu.Lock()
+	defer q.depthMu.Unlock()
+	q.depth += n
+}
+
+// transmit queued codes one at a time, keeping the air gap between them
+func (q *Queue) run() {
+	var lastSent time.Time
+	for job := range q.jobs {
+		if wait := q.airGap - time.Since(lastSent); wait > 0 {
+			time.Sleep(wait)
+		}
+		if job.toggle {
+			job.code = toggledCode(job.sw)
+		}
+		job.result <- sendCode(job.sw, job.code)
+		lastSent = time.Now()
+		q.addDepth(-1)
+	}
+}
+
+var (
+	queue     *Queue
+	queueMu   sync.Mutex
+	queueOnce sync.Once
+)
+
+// SetQueue replaces the transmit queue. The previous queue is closed after
+// it finishes transmitting what it already holds.
+func SetQueue(q *Queue) {
+	queueOnce.Do(func() {})
+	queueMu.Lock()
+	old := queue
+	queue = q
+	queueMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// getQueue returns the transmit queue, creating a default one if needed
+func getQueue() *Queue {
+	queueOnce.Do(func() {
+		queueMu.Lock()
+		queue = NewQueue(QueueConfig{})
+		queueMu.Unlock()
+	})
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	return queue
+}
+
+// QueueDepth is the number of codes waiting to be transmitted
+func QueueDepth() int {
+	return getQueue().Len()
+}
+
+// QueueHandler reports the depth of the transmit queue
+func QueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	depth := QueueDepth()
+	apihelpers.EncodeJSON(w, http.StatusOK, map[string]interface{}{
+		"depth":   depth,
+		"message": fmt.Sprintf("%d codes waiting to be sent", depth),
+	})
+}
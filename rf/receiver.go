@@ -0,0 +1,419 @@
+package rf
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// footerThreshold is the pulse length (in microseconds) above which a pulse
+// is considered the footer that ends a train
+const footerThreshold = 2500
+
+// pulseTolerance is how far a received pulse may stray from its nominal length
+const pulseTolerance = 0.35
+
+// ReceiverConfig describes where received pulses come from
+// Type (string): "pilight | socket | file", empty disables receiving
+// Host, Port: the pilight daemon or a socket streaming raw pulses
+// Path: a file or named pipe streaming raw pulses
+type ReceiverConfig struct {
+	Type string `json:"type"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	Path string `json:"path"`
+}
+
+// Received is a code decoded from the air. Alternatives are the same train
+// decoded with other encodings it also fits.
+type Received struct {
+	Code         int        `json:"code"`
+	Encoding     string     `json:"encoding"`
+	Time         time.Time  `json:"time"`
+	Alternatives []Received `json:"alternatives,omitempty"`
+}
+
+// As returns the code decoded with the named encoding, if the train fits it
+func (r Received) As(encoding string) (int, bool) {
+	if strings.EqualFold(r.Encoding, encoding) {
+		return r.Code, true
+	}
+	for _, alt := range r.Alternatives {
+		if strings.EqualFold(alt.Encoding, encoding) {
+			return alt.Code, true
+		}
+	}
+	return 0, false
+}
+
+// PulseSource yields raw pulse trains (in microseconds) as they are received
+type PulseSource interface {
+	Next() ([]int, error)
+	Close() error
+}
+
+// ----------------------------------------------------------------------------
+// Raw pulse streams
+// ----------------------------------------------------------------------------
+
+// ReaderSource reads whitespace separated pulse lengths, one train per line
+type ReaderSource struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+}
+
+// NewReaderSource reads pulses from r, closing it (if possible) on Close
+func NewReaderSource(r io.Reader) *ReaderSource {
+	s := &ReaderSource{scanner: bufio.NewScanner(r)}
+	s.scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if closer, ok := r.(io.Closer); ok {
+		s.closer = closer
+	}
+	return s
+}
+
+// Next returns the pulses on the next non-empty line
+func (s *ReaderSource) Next() ([]int, error) {
+	for s.scanner.Scan() {
+		pulses, err := parsePulses(s.scanner.Text())
+		if err != nil {
+			log.Printf("error: ignoring malformed pulses: %q\n", err)
+			continue
+		}
+		if len(pulses) > 0 {
+			return pulses, nil
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close closes the underlying reader
+func (s *ReaderSource) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// parse a line of whitespace separated pulse lengths
+func parsePulses(line string) ([]int, error) {
+	fields := strings.Fields(line)
+	pulses := make([]int, 0, len(fields))
+	for _, f := range fields {
+		p, err := strconv.Atoi(f)
+		if err != nil || p <= 0 {
+			return nil, fmt.Errorf("invalid pulse length %q", f)
+		}
+		pulses = append(pulses, p)
+	}
+	return pulses, nil
+}
+
+// ----------------------------------------------------------------------------
+// pilight receiver events
+// ----------------------------------------------------------------------------
+
+// PilightReceiver identifies with the pilight daemon as a receiver and yields
+// the pulses of raw receiver events
+type PilightReceiver struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// pilight receiver event
+type pilightEvent struct {
+	Origin   string `json:"origin"`
+	Protocol string `json:"protocol"`
+	Message  struct {
+		Code string `json:"code"`
+	} `json:"message"`
+}
+
+// NewPilightReceiver connects to the daemon at address (host:port)
+func NewPilightReceiver(address string) (*PilightReceiver, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	p := &PilightReceiver{conn: conn, reader: bufio.NewReader(conn)}
+	identify := map[string]interface{}{
+		"action": "identify",
+		"options": map[string]int{
+			"core": 0, "receiver": 1, "config": 0, "forward": 0,
+		},
+	}
+	payload, _ := json.Marshal(identify)
+	if _, err := conn.Write(append(payload, '\n')); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Next waits for the next receiver event that carries raw pulses
+func (p *PilightReceiver) Next() ([]int, error) {
+	for {
+		line, err := p.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		event := pilightEvent{}
+		if err := json.Unmarshal(line, &event); err != nil {
+			// status responses and heartbeats aren't events
+			continue
+		}
+		if event.Origin != "receiver" || event.Message.Code == "" {
+			continue
+		}
+		pulses, err := parsePulses(event.Message.Code)
+		if err != nil {
+			log.Printf("error: ignoring malformed pilight event: %q\n", err)
+			continue
+		}
+		return pulses, nil
+	}
+}
+
+// Close disconnects from the daemon
+func (p *PilightReceiver) Close() error {
+	return p.conn.Close()
+}
+
+// openPulseSource opens the source described by the config
+func openPulseSource(c ReceiverConfig) (PulseSource, error) {
+	if c.Host == "" {
+		c.Host = "127.0.0.1"
+	}
+	address := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	switch c.Type {
+	case "pilight":
+		if c.Port == 0 {
+			address = net.JoinHostPort(c.Host, "5000")
+		}
+		return NewPilightReceiver(address)
+	case "socket":
+		conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return NewReaderSource(conn), nil
+	case "file":
+		f, err := os.Open(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		return NewReaderSource(f), nil
+	}
+	return nil, fmt.Errorf("error: unknown receiver type: %q", c.Type)
+}
+
+// ----------------------------------------------------------------------------
+// Decoding
+// ----------------------------------------------------------------------------
+
+// near reports whether a received pulse matches a nominal length
+func near(pulse, nominal int) bool {
+	return deviation(pulse, nominal) <= pulseTolerance
+}
+
+// how far a received pulse strays from a nominal length, relative to it
+func deviation(pulse, nominal int) float64 {
+	diff := float64(pulse - nominal)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff / float64(nominal)
+}
+
+// Convert a pilight raw pulse train back into its decimal representation.
+// This is the inverse of decimalToRaw. Besides the code it returns the mean
+// deviation of the pulses from the encoding's timings, to tell apart
+// encodings whose timings are within tolerance of each other.
+func rawToDecimal(pulses []int, e Encoding) (int, float64, bool) {
+	// codes wider than an int can't be matched against any switch
+	if len(pulses) != 2*e.Bits+2 || e.Bits >= strconv.IntSize {
+		return 0, 0, false
+	}
+	// the footer only needs to be long enough: repeats may stretch it
+	footer := float64(pulses[len(pulses)-1])
+	if !near(pulses[len(pulses)-2], e.Short) || footer < float64(e.Footer)*(1-pulseTolerance) {
+		return 0, 0, false
+	}
+	code := 0
+	total := deviation(pulses[len(pulses)-2], e.Short)
+	for i := 0; i < e.Bits; i++ {
+		high, low := pulses[2*i], pulses[2*i+1]
+		bit := 0
+		switch {
+		case near(high, e.Short) && near(low, e.Long):
+			total += deviation(high, e.Short) + deviation(low, e.Long)
+		case near(high, e.Long) && near(low, e.Short):
+			total += deviation(high, e.Long) + deviation(low, e.Short)
+			bit = 1
+		default:
+			return 0, 0, false
+		}
+		if e.BitOrder == LSBFirst {
+			code |= bit << uint(i)
+		} else {
+			code = code<<1 | bit
+		}
+	}
+	return code, total / float64(2*e.Bits+1), true
+}
+
+// split a pulse stream into trains, each ending with its footer
+func splitTrains(pulses []int) [][]int {
+	var trains [][]int
+	start := 0
+	for i, p := range pulses {
+		if p >= footerThreshold {
+			trains = append(trains, pulses[start:i+1])
+			start = i + 1
+		}
+	}
+	return trains
+}
+
+// decode every train in a pulse stream. Encodings with similar timings (e.g.
+// PT2262 and EV1527) can both fit a train: the closest fit is reported and
+// the others are kept as alternatives.
+func decodePulses(pulses []int) []Received {
+	encodingsMu.RLock()
+	names := make([]string, 0, len(encodings))
+	for name := range encodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	candidates := make([]Encoding, 0, len(names))
+	for _, name := range names {
+		candidates = append(candidates, encodings[name])
+	}
+	encodingsMu.RUnlock()
+
+	var received []Received
+	now := time.Now()
+	for _, train := range splitTrains(pulses) {
+		var fits []Received
+		var deviations []float64
+		for _, e := range candidates {
+			if code, dev, ok := rawToDecimal(train, e); ok {
+				fits = append(fits, Received{Code: code, Encoding: e.Name, Time: now})
+				deviations = append(deviations, dev)
+			}
+		}
+		if len(fits) == 0 {
+			continue
+		}
+		best := 0
+		for i := range fits {
+			if deviations[i] < deviations[best] {
+				best = i
+			}
+		}
+		r := fits[best]
+		for i := range fits {
+			if i != best {
+				r.Alternatives = append(r.Alternatives, fits[i])
+			}
+		}
+		received = append(received, r)
+	}
+	return received
+}
+
+// ----------------------------------------------------------------------------
+// Receive loop
+// ----------------------------------------------------------------------------
+
+var (
+	listeners   = make(map[int]func(Received))
+	listenerID  int
+	listenersMu sync.Mutex
+)
+
+// addListener registers a function to be called with every decoded code
+// and returns a function that removes it again
+func addListener(f func(Received)) func() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listenerID++
+	id := listenerID
+	listeners[id] = f
+	return func() {
+		listenersMu.Lock()
+		defer listenersMu.Unlock()
+		delete(listeners, id)
+	}
+}
+
+// dispatch a decoded code to every listener
+func dispatch(r Received) {
+	listenersMu.Lock()
+	current := make([]func(Received), 0, len(listeners))
+	for _, f := range listeners {
+		current = append(current, f)
+	}
+	listenersMu.Unlock()
+	for _, f := range current {
+		f(r)
+	}
+}
+
+// number of running receive loops
+var receiving int32
+
+// Receiving reports whether a receiver is running
+func Receiving() bool {
+	return atomic.LoadInt32(&receiving) > 0
+}
+
+// Receive continuously reads pulses from the configured source and decodes
+// them, keeping switch states in sync with their physical remotes. Broken
+// connections are re-established; a file source stops at its end.
+func Receive(c ReceiverConfig) {
+	atomic.AddInt32(&receiving, 1)
+	defer atomic.AddInt32(&receiving, -1)
+	trackRemotes()
+	for {
+		src, err := openPulseSource(c)
+		if err != nil {
+			log.Printf("error: could not open rf receiver: %q\n", err)
+		} else {
+			err = receiveFrom(src)
+			src.Close()
+			if err == io.EOF && c.Type == "file" {
+				log.Printf("action: rf receiver reached the end of %q\n", c.Path)
+				return
+			}
+			log.Printf("error: rf receiver stopped: %q\n", err)
+		}
+		<-time.After(5 * time.Second)
+	}
+}
+
+// decode pulses from a source until it fails
+func receiveFrom(src PulseSource) error {
+	for {
+		pulses, err := src.Next()
+		if err != nil {
+			return err
+		}
+		for _, r := range decodePulses(pulses) {
+			dispatch(r)
+		}
+	}
+}
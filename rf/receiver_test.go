@@ -0,0 +1,111 @@
+package rf
+
+import (
+	"testing"
+)
+
+// encode a code and decode it again as if it was received
+func roundTrip(t *testing.T, code int, e Encoding) []Received {
+	pulses, err := parsePulses(decimalToRaw(code, e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodePulses(pulses)
+}
+
+func TestDecodePresets(t *testing.T) {
+	tests := []struct {
+		encoding Encoding
+		code     int
+	}{
+		{Etekcity, 1398067},
+		{Etekcity, 0},
+		{PT2262, 1398067},
+		{PT2262, 1<<24 - 1},
+		{EV1527, 1398067},
+		{EV1527, 5592405},
+	}
+	for _, test := range tests {
+		received := roundTrip(t, test.code, test.encoding)
+		if len(received) != 1 {
+			t.Errorf("%s %d: got %d codes, want 1", test.encoding.Name, test.code, len(received))
+			continue
+		}
+		r := received[0]
+		if r.Encoding != test.encoding.Name || r.Code != test.code {
+			t.Errorf("%s %d: decoded as %s %d", test.encoding.Name, test.code, r.Encoding, r.Code)
+		}
+		if code, ok := r.As(test.encoding.Name); !ok || code != test.code {
+			t.Errorf("%s %d: As returned %d, %v", test.encoding.Name, test.code, code, ok)
+		}
+	}
+}
+
+func TestDecodeAlternatives(t *testing.T) {
+	// PT2262 timings are within tolerance of EV1527 ones
+	received := roundTrip(t, 1398067, PT2262)
+	if len(received) != 1 {
+		t.Fatalf("got %d codes, want 1", len(received))
+	}
+	if code, ok := received[0].As(EV1527.Name); !ok || code != 1398067 {
+		t.Errorf("missing ev1527 alternative: %+v", received[0])
+	}
+	if _, ok := received[0].As("unknown"); ok {
+		t.Error("As matched an unknown encoding")
+	}
+}
+
+func TestDecodeRepeats(t *testing.T) {
+	raw := decimalToRaw(4543795, PT2262)
+	pulses, err := parsePulses(raw + " " + raw + " " + raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := decodePulses(pulses)
+	if len(received) != 3 {
+		t.Fatalf("got %d codes, want 3", len(received))
+	}
+	for _, r := range received {
+		if r.Code != 4543795 || r.Encoding != PT2262.Name {
+			t.Errorf("decoded as %s %d", r.Encoding, r.Code)
+		}
+	}
+}
+
+func TestDecodeNoise(t *testing.T) {
+	pulses, err := parsePulses("100 200 300 4000 174 522 5916")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received := decodePulses(pulses); len(received) != 0 {
+		t.Errorf("decoded noise as %+v", received)
+	}
+}
+
+func TestTrackRemotes(t *testing.T) {
+	if err := SetSwitches([]Switch{{Name: "porch", On: 1398067, Off: 1398076, Encoding: PT2262.Name}}); err != nil {
+		t.Fatal(err)
+	}
+	trackRemotes()
+
+	tests := []struct {
+		received Received
+		state    string
+	}{
+		{roundTrip(t, 1398067, PT2262)[0], "on"},
+		// a noisy train can fit another encoding better
+		{Received{Code: 1398076, Encoding: EV1527.Name, Alternatives: []Received{{Code: 1398076, Encoding: PT2262.Name}}}, "off"},
+		// codes in other encodings are not the switch's remote
+		{Received{Code: 1398067, Encoding: EV1527.Name}, "off"},
+	}
+	for i, test := range tests {
+		dispatch(test.received)
+		state, err := GetState("porch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.State != test.state {
+			t.Errorf("%d: got state %q, want %q", i, state.State, test.state)
+		}
+	}
+}
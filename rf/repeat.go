@@ -0,0 +1,115 @@
+package rf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repeat modes
+// train: every repetition is packed into a single raw pulse train
+// send: the code is handed to the transmitter once per repetition
+const (
+	RepeatTrain = "train"
+	RepeatSend  = "send"
+)
+
+// maxRepeat keeps raw pulse trains within what pilight accepts
+const maxRepeat = 20
+
+// RepeatConfig controls how many times a code is sent and the gap
+// (in milliseconds) between repetitions
+type RepeatConfig struct {
+	Count int    `json:"count"`
+	Gap   int    `json:"gap"`
+	Mode  string `json:"mode"`
+}
+
+var (
+	repeatDefaults   = RepeatConfig{Count: 1, Mode: RepeatTrain}
+	repeatDefaultsMu sync.RWMutex
+)
+
+// validate a repeat count and gap
+func validateRepeat(count, gap int) error {
+	if count < 0 || count > maxRepeat {
+		return fmt.Errorf("repeat count must be between 1 and %d", maxRepeat)
+	}
+	if gap < 0 {
+		return fmt.Errorf("repeat gap must not be negative")
+	}
+	return nil
+}
+
+// SetRepeatDefaults sets the repeat behaviour for switches that don't
+// define their own
+func SetRepeatDefaults(c RepeatConfig) error {
+	if c.Count == 0 {
+		c.Count = 1
+	}
+	if c.Mode == "" {
+		c.Mode = RepeatTrain
+	}
+	if err := validateRepeat(c.Count, c.Gap); err != nil {
+		return fmt.Errorf("error: %v", err)
+	}
+	if c.Mode != RepeatTrain && c.Mode != RepeatSend {
+		return fmt.Errorf("error: repeat mode must be %q or %q", RepeatTrain, RepeatSend)
+	}
+	repeatDefaultsMu.Lock()
+	defer repeatDefaultsMu.Unlock()
+	repeatDefaults = c
+	return nil
+}
+
+// repeatFor merges a switch's repeat settings with the defaults
+func repeatFor(s Switch) RepeatConfig {
+	repeatDefaultsMu.RLock()
+	c := repeatDefaults
+	repeatDefaultsMu.RUnlock()
+	if s.Repeat > 0 {
+		c.Count = s.Repeat
+	}
+	if s.Gap > 0 {
+		c.Gap = s.Gap
+	}
+	return c
+}
+
+// repeatRaw packs count copies of a raw pulse train into one, stretching the
+// footer of every copy but the last by the gap
+func repeatRaw(raw string, count, gap int) string {
+	if count <= 1 {
+		return raw
+	}
+	pulses := strings.Fields(raw)
+	footer, _ := strconv.Atoi(pulses[len(pulses)-1])
+	pulses[len(pulses)-1] = strconv.Itoa(footer + gap*1000)
+	spaced := strings.Join(pulses, " ")
+
+	trains := make([]string, 0, count)
+	for i := 0; i < count-1; i++ {
+		trains = append(trains, spaced)
+	}
+	trains = append(trains, raw)
+	return strings.Join(trains, " ")
+}
+
+// transmit the code as many times as the switch asks for
+func transmitRepeated(t Transmitter, s Switch, protocol, code string) error {
+	c := repeatFor(s)
+	if c.Mode == RepeatTrain && protocol == "raw" {
+		return t.Transmit(protocol, repeatRaw(code, c.Count, c.Gap))
+	}
+	for i := 0; i < c.Count; i++ {
+		if i > 0 && c.Gap > 0 {
+			time.Sleep(time.Duration(c.Gap) * time.Millisecond)
+		}
+		if err := t.Transmit(protocol, code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
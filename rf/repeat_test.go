@@ -0,0 +1,78 @@
+package rf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRepeatRaw(t *testing.T) {
+	tests := []struct {
+		raw        string
+		count, gap int
+		want       string
+	}{
+		{"1 3 1 9", 0, 10, "1 3 1 9"},
+		{"1 3 1 9", 1, 10, "1 3 1 9"},
+		{"1 3 1 9", 2, 0, "1 3 1 9 1 3 1 9"},
+		{"1 3 1 9", 3, 10, "1 3 1 10009 1 3 1 10009 1 3 1 9"},
+	}
+	for _, test := range tests {
+		if got := repeatRaw(test.raw, test.count, test.gap); got != test.want {
+			t.Errorf("%q x%d gap %d: got %q, want %q", test.raw, test.count, test.gap, got, test.want)
+		}
+	}
+}
+
+func TestTransmitRepeated(t *testing.T) {
+	raw := decimalToRaw(1398067, Etekcity)
+	tests := []struct {
+		defaults RepeatConfig
+		sw       Switch
+		protocol string
+		sends    int
+		trains   int
+	}{
+		{RepeatConfig{}, Switch{}, "raw", 1, 1},
+		{RepeatConfig{Count: 3}, Switch{}, "raw", 1, 3},
+		{RepeatConfig{Count: 3, Mode: RepeatSend}, Switch{}, "raw", 3, 1},
+		{RepeatConfig{Count: 3}, Switch{Repeat: 5}, "raw", 1, 5},
+		{RepeatConfig{Count: 2}, Switch{}, "arctech_switch", 2, 1},
+	}
+	for i, test := range tests {
+		if err := SetRepeatDefaults(test.defaults); err != nil {
+			t.Fatal(err)
+		}
+		recorder := &Recorder{}
+		if err := transmitRepeated(recorder, test.sw, test.protocol, raw); err != nil {
+			t.Fatal(err)
+		}
+		sent := recorder.Transmissions()
+		if len(sent) != test.sends {
+			t.Errorf("%d: got %d transmissions, want %d", i, len(sent), test.sends)
+			continue
+		}
+		if trains := len(strings.Fields(sent[0].Code)) / len(strings.Fields(raw)); trains != test.trains {
+			t.Errorf("%d: got %d trains per transmission, want %d", i, trains, test.trains)
+		}
+	}
+	SetRepeatDefaults(RepeatConfig{})
+}
+
+func TestSetRepeatDefaults(t *testing.T) {
+	tests := []struct {
+		c  RepeatConfig
+		ok bool
+	}{
+		{RepeatConfig{}, true},
+		{RepeatConfig{Count: maxRepeat, Gap: 10, Mode: RepeatSend}, true},
+		{RepeatConfig{Count: maxRepeat + 1}, false},
+		{RepeatConfig{Gap: -1}, false},
+		{RepeatConfig{Mode: "burst"}, false},
+	}
+	for _, test := range tests {
+		if err := SetRepeatDefaults(test.c); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v, want ok %v", test.c, err, test.ok)
+		}
+	}
+	SetRepeatDefaults(RepeatConfig{})
+}
@@ -1,115 +1,381 @@
 package rf
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"homeautomation/apihelpers"
 	"net/http"
-	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Switch contains an "on" and an "off" attribute. These attributes
 // are integer representations of the RF codes to send.
 type Switch struct {
-	On, Off int
+	Name     string `json:"name"`
+	On       int    `json:"on"`
+	Off      int    `json:"off"`
+	Protocol string `json:"protocol,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Repeat   int    `json:"repeat,omitempty"`
+	Gap      int    `json:"gap,omitempty"`
 }
 
-// Convert a decimal representation of signal to pilight raw
-func decimalToRaw(n int) string {
-	rf0 := "174 522"
-	rf1 := "522 174"
-	rffoot := "174 5916"
-	bin := make([]string, 0, 25)
+// protocol returns the pilight protocol used to send the switch's codes
+func (s Switch) protocol() string {
+	if s.Protocol == "" {
+		return "raw"
+	}
+	return s.Protocol
+}
+
+// SendCode queues one of the switch's rf codes for transmission and waits
+// until it has been sent
+func SendCode(s Switch, code int) error {
+	return getQueue().Send(s, code)
+}
+
+// sendCode hands one of the switch's rf codes to the configured transmitter,
+// repeating it as configured for the switch
+func sendCode(s Switch, code int) error {
+	codeStr := strconv.Itoa(code)
+	if s.protocol() == "raw" {
+		encoding, err := LookupEncoding(s.Encoding)
+		if err != nil {
+			return err
+		}
+		codeStr = decimalToRaw(code, encoding)
+	}
+	if err := transmitRepeated(getTransmitter(), s, s.protocol(), codeStr); err != nil {
+		return err
+	}
+	recordState(s, code, SourceTransmitter)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Switch Registry
+// ----------------------------------------------------------------------------
+var (
+	switches   []Switch
+	switchesMu sync.RWMutex
+)
 
-	for n > 0 {
-		if n%2 == 0 {
-			bin = append(bin, rf0)
-		} else {
-			bin = append(bin, rf1)
+// ValidateSwitches makes sure a set of switch definitions is usable
+func ValidateSwitches(s []Switch) error {
+	names := make(map[string]bool)
+	for i, sw := range s {
+		name := strings.ToLower(strings.TrimSpace(sw.Name))
+		if name == "" {
+			return fmt.Errorf("error: switch %d: missing name", i)
+		}
+		// names that look like numbers would be shadowed by index lookups
+		if _, err := strconv.Atoi(name); err == nil {
+			return fmt.Errorf("error: switch %d: name %q must not be a number", i, sw.Name)
+		}
+		if names[name] {
+			return fmt.Errorf("error: switch %d: duplicate name %q", i, sw.Name)
+		}
+		if name == AllGroup || isGroup(name) {
+			return fmt.Errorf("error: switch %q has the same name as a group", sw.Name)
+		}
+		names[name] = true
+		if sw.On <= 0 || sw.Off <= 0 {
+			return fmt.Errorf("error: switch %q: on and off codes must be positive", sw.Name)
+		}
+		if sw.On == sw.Off {
+			return fmt.Errorf("error: switch %q: on and off codes must differ", sw.Name)
+		}
+		if err := validateRepeat(sw.Repeat, sw.Gap); err != nil {
+			return fmt.Errorf("error: switch %q: %v", sw.Name, err)
+		}
+		if sw.protocol() == "raw" {
+			encoding, err := LookupEncoding(sw.Encoding)
+			if err != nil {
+				return fmt.Errorf("error: switch %q: %v", sw.Name, err)
+			}
+			if !encoding.Fits(sw.On) || !encoding.Fits(sw.Off) {
+				return fmt.Errorf("error: switch %q: codes do not fit in %d bits", sw.Name, encoding.Bits)
+			}
 		}
-		n = n / 2
 	}
-	for len(bin) < 24 {
-		bin = append(bin, rf0)
+
+	// rooms are groups too, so their names must not clash with anything else
+	for _, sw := range s {
+		room := roomKey(sw)
+		switch {
+		case room == "":
+		case room == AllGroup:
+			return fmt.Errorf("error: switch %q: room %q is reserved", sw.Name, sw.Room)
+		case names[room]:
+			return fmt.Errorf("error: switch %q: room %q has the same name as a switch", sw.Name, sw.Room)
+		case isGroup(room):
+			return fmt.Errorf("error: switch %q: room %q has the same name as a group", sw.Name, sw.Room)
+		}
 	}
-	for i := 0; i < 12; i++ {
-		bin[i], bin[23-i] = bin[23-i], bin[i]
+	return nil
+}
+
+// SetSwitches validates and installs the switches that can be controlled
+func SetSwitches(s []Switch) error {
+	if err := ValidateSwitches(s); err != nil {
+		return err
 	}
-	bin = append(bin, rffoot)
-	return strings.Join(bin, " ")
+	switchesMu.Lock()
+	defer switchesMu.Unlock()
+	switches = make([]Switch, len(s))
+	copy(switches, s)
+	return nil
+}
+
+// Switches returns a copy of the configured switches
+func Switches() []Switch {
+	switchesMu.RLock()
+	defer switchesMu.RUnlock()
+	s := make([]Switch, len(switches))
+	copy(s, switches)
+	return s
 }
 
-// SendCode executes the External "pilight-send" command given an rf code
-func SendCode(code int) error {
-	binCode := decimalToRaw(code)
-	pilightArgs := []string{"-S", "127.0.0.1", "-P", "5000", "-p", "raw", "-c", binCode}
-	cmd := exec.Command("pilight-send", pilightArgs...)
-	return cmd.Run()
+// FindSwitch looks up a switch either by its index or by its name
+func FindSwitch(id string) (int, Switch, error) {
+	switchesMu.RLock()
+	defer switchesMu.RUnlock()
+
+	id = strings.TrimSpace(id)
+	if index, err := strconv.Atoi(id); err == nil {
+		if index < 0 || index > len(switches)-1 {
+			return 0, Switch{}, errors.New("error: invalid switch number: " + id)
+		}
+		return index, switches[index], nil
+	}
+	for i, sw := range switches {
+		if strings.EqualFold(sw.Name, id) {
+			return i, sw, nil
+		}
+	}
+	return 0, Switch{}, errors.New("error: unknown switch: " + id)
 }
 
 // ----------------------------------------------------------------------------
 // API Handler for switches
 // ----------------------------------------------------------------------------
-var switches = []Switch{
-	Switch{On: 1398067, Off: 1398076},
-	Switch{On: 1398211, Off: 1398220},
-	Switch{On: 1398531, Off: 1398540},
-	Switch{On: 1400067, Off: 1400076},
-	Switch{On: 1406211, Off: 1406220},
+
+// SwitchRef references a switch by index or name. In JSON it can be given
+// either as a number or as a string.
+type SwitchRef string
+
+// UnmarshalJSON accepts both numbers and strings
+func (s *SwitchRef) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*s = SwitchRef(name)
+		return nil
+	}
+	var index int
+	if err := json.Unmarshal(b, &index); err != nil {
+		return errors.New("error: switch must be a number or a name")
+	}
+	*s = SwitchRef(strconv.Itoa(index))
+	return nil
+}
+
+// ValidState reports whether a switch can be set to the state
+func ValidState(state string) bool {
+	switch strings.ToLower(state) {
+	case "on", "off", "toggle":
+		return true
+	}
+	return false
 }
 
 // SwitchHandler is an HTTP Handler that deals with calls to turn switches on and off.
-// Query Params Supported:
-// state (string): "on | off"
-// switch (int): which switch from the remote to use
+// A GET returns the last known state of the switch, or of every switch if no
+// switch is given. Setting a state takes a POST or PUT.
+// Query Params or JSON Body Supported:
+// state (string): "on | off | toggle"
+// switch (string): which switch to use, either its index or its name
+// for (string): optional duration after which the switch is set back, e.g. "30m"
 func SwitchHandler(w http.ResponseWriter, r *http.Request) {
-	state := r.URL.Query().Get("state")
-	switchNum := r.URL.Query().Get("switch")
-	if state == "" || switchNum == "" {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodPut {
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodPut)
+		return
+	}
+	request := switchRequest{
+		Switch: SwitchRef(r.URL.Query().Get("switch")),
+		State:  r.URL.Query().Get("state"),
+		For:    r.URL.Query().Get("for"),
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid JSON Body")
+			return
+		}
+	}
+	switchID := string(request.Switch)
+	if r.Method == http.MethodGet {
+		if request.State != "" {
+			apihelpers.EncodeMethodNotAllowed(w, http.MethodPost, http.MethodPut)
+			return
+		}
+		if switchID == "" {
+			StatesHandler(w, r)
+			return
+		}
+		stateHandler(w, r, switchID)
+		return
+	}
+	if request.State == "" || switchID == "" {
 		apihelpers.EncodeError(w, http.StatusBadRequest, "Missing Switch Number or State")
 		return
 	}
 
 	// Get the correspodning switch to turn on
-	intSwitchNum, err := strconv.Atoi(switchNum)
-	if err != nil || intSwitchNum > (len(switches)-1) {
-		apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid Switch Number")
+	if _, _, err := FindSwitch(switchID); err != nil {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid Switch Number or Name")
+		return
+	}
+	applySwitchRequest(w, switchID, request)
+}
+
+// SwitchesHandler is an HTTP Handler for switches as resources.
+// GET /api/switches lists every switch and its last known state
+// GET /api/switches/{id} returns a single switch
+// PUT /api/switches/{id} sets a switch from a JSON body, e.g. {"state": "on", "for": "30m"}
+// Switches are referenced by index or by name.
+func SwitchesHandler(w http.ResponseWriter, r *http.Request) {
+	switchID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/switches"), "/")
+	if switchID == "" {
+		if r.Method != http.MethodGet {
+			apihelpers.EncodeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		StatesHandler(w, r)
 		return
 	}
 
+	switch r.Method {
+	case http.MethodGet:
+		stateHandler(w, r, switchID)
+	case http.MethodPut:
+		if _, _, err := FindSwitch(switchID); err != nil {
+			apihelpers.EncodeError(w, http.StatusNotFound, "Invalid Switch Number or Name")
+			return
+		}
+		request := switchRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid JSON Body")
+			return
+		}
+		if request.State == "" {
+			apihelpers.EncodeError(w, http.StatusBadRequest, "Missing State")
+			return
+		}
+		applySwitchRequest(w, switchID, request)
+	default:
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
+
+// parameters for setting a switch
+type switchRequest struct {
+	Switch SwitchRef `json:"switch"`
+	State  string    `json:"state"`
+	For    string    `json:"for"`
+}
+
+// set a switch as requested and respond with its new state
+func applySwitchRequest(w http.ResponseWriter, switchID string, request switchRequest) {
 	// Get the state to set the switch to
-	state = strings.ToLower(state)
-	if state != "on" && state != "off" {
-		apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid State: must be \"on\" or \"off\"")
+	state := strings.ToLower(request.State)
+	if !ValidState(state) {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid State: must be \"on\", \"off\" or \"toggle\"")
 		return
 	}
 
+	// Get how long the state should last
+	var duration time.Duration
+	if request.For != "" {
+		var err error
+		if duration, err = time.ParseDuration(request.For); err != nil || duration <= 0 {
+			apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid Duration")
+			return
+		}
+	}
+
 	// Set the switch state
-	err = SetSwitch(intSwitchNum, state)
+	var timer Timer
+	var err error
+	if duration > 0 {
+		timer, err = SetSwitchFor(switchID, state, duration)
+	} else {
+		err = SetSwitch(switchID, state)
+	}
 
 	// Handle errors from pilight
 	if err != nil {
-		apihelpers.EncodeError(w, http.StatusInternalServerError, "Unable to send RF Code")
+		apihelpers.EncodeError(w, http.StatusInternalServerError, "Unable to send RF Code: "+err.Error())
 		return
 	}
+
 	// Success!
-	success := fmt.Sprintf("Successfully turned switch %d %s", intSwitchNum, state)
-	apihelpers.EncodeJSON(w, http.StatusOK, map[string]string{"message": success})
+	current, err := GetState(switchID)
+	if err != nil {
+		apihelpers.EncodeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	success := fmt.Sprintf("Successfully turned switch %s %s", current.Name, current.State)
+	response := map[string]interface{}{"message": success, "switch": current}
+	if duration > 0 {
+		response["message"] = success + " for " + duration.String()
+		response["timer"] = timer
+	}
+	apihelpers.EncodeJSON(w, http.StatusOK, response)
+}
+
+// SetSwitch sets a particular switch in the desired on/off/toggle state and
+// waits for the code to be sent. The switch can be referenced by its index or by its name.
+// A pending timer of the switch is cancelled.
+func SetSwitch(switchID string, state string) error {
+	job, err := switchJob(switchID, state)
+	if err != nil {
+		return err
+	}
+	cancelTimers(job.sw.Name)
+	// Send the code
+	return <-getQueue().submit(job)
+}
+
+// SetSwitchAsync queues the code for a switch state without waiting for it
+// to be sent. Only lookup errors are returned; send failures are logged.
+func SetSwitchAsync(switchID string, state string) error {
+	job, err := switchJob(switchID, state)
+	if err != nil {
+		return err
+	}
+	cancelTimers(job.sw.Name)
+	getQueue().enqueue(job)
+	return nil
 }
 
-// SetSwitch sets a particular switch in the desired on/off state
-func SetSwitch(switchNum int, state string) error {
-	if switchNum > len(switches)-1 {
-		return errors.New("error: invalid switch number: " + strconv.Itoa(switchNum))
+// switchJob finds a switch and the code to transmit for the state
+func switchJob(switchID string, state string) (*queueJob, error) {
+	_, selectedSwitch, err := FindSwitch(switchID)
+	if err != nil {
+		return nil, err
 	}
 	// Get the code we want to transmit
-	selectedSwitch := switches[switchNum]
-	code := selectedSwitch.On
-	if state == "off" {
-		code = selectedSwitch.Off
+	switch strings.ToLower(state) {
+	case "on":
+		return &queueJob{sw: selectedSwitch, code: selectedSwitch.On}, nil
+	case "off":
+		return &queueJob{sw: selectedSwitch, code: selectedSwitch.Off}, nil
+	case "toggle":
+		return &queueJob{sw: selectedSwitch, toggle: true}, nil
 	}
-	// Send the code
-	return SendCode(code)
+	return nil, errors.New("error: invalid state: " + state)
 }
@@ -0,0 +1,337 @@
+package rf
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// send codes to a recorder for the switches, without any state on disk
+func setupRecorder(t *testing.T, switches []Switch) *Recorder {
+	recorder := &Recorder{}
+	SetTransmitter(recorder)
+	SetQueue(NewQueue(QueueConfig{}))
+	if err := SetRepeatDefaults(RepeatConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSwitches(switches); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetGroups(nil); err != nil {
+		t.Fatal(err)
+	}
+	statesMu.Lock()
+	states = make(map[string]savedState)
+	stateFile = ""
+	statesMu.Unlock()
+	timersMu.Lock()
+	stopAllTimers()
+	timerFile = ""
+	timersMu.Unlock()
+	return recorder
+}
+
+var testSwitches = []Switch{
+	{Name: "lamp", On: 1398067, Off: 1398076, Room: "den"},
+	{Name: "fan", On: 4543795, Off: 4543804, Encoding: PT2262.Name, Room: "den"},
+	{Name: "heater", On: 12, Off: 13, Protocol: "arctech_switch"},
+}
+
+func TestSetSwitch(t *testing.T) {
+	tests := []struct {
+		id, state string
+		want      Transmission
+		after     string
+	}{
+		{"lamp", "on", Transmission{"raw", decimalToRaw(1398067, Etekcity)}, "on"},
+		{"0", "off", Transmission{"raw", decimalToRaw(1398076, Etekcity)}, "off"},
+		{"LAMP", "on", Transmission{"raw", decimalToRaw(1398067, Etekcity)}, "on"},
+		{"fan", "on", Transmission{"raw", decimalToRaw(4543795, PT2262)}, "on"},
+		{"heater", "off", Transmission{"arctech_switch", "13"}, "off"},
+	}
+	recorder := setupRecorder(t, testSwitches)
+	for _, test := range tests {
+		recorder.Reset()
+		if err := SetSwitch(test.id, test.state); err != nil {
+			t.Fatalf("%s %s: %v", test.id, test.state, err)
+		}
+		sent := recorder.Transmissions()
+		if len(sent) != 1 || sent[0] != test.want {
+			t.Errorf("%s %s: sent %v, want %v", test.id, test.state, sent, test.want)
+		}
+		if state, _ := GetState(test.id); state.State != test.after {
+			t.Errorf("%s %s: state is %q, want %q", test.id, test.state, state.State, test.after)
+		}
+	}
+}
+
+func TestSetSwitchErrors(t *testing.T) {
+	recorder := setupRecorder(t, testSwitches)
+	tests := []struct {
+		id, state string
+	}{
+		{"lamp", "dim"},
+		{"garage", "on"},
+		{"3", "on"},
+		{"-1", "off"},
+	}
+	for _, test := range tests {
+		if err := SetSwitch(test.id, test.state); err == nil {
+			t.Errorf("%s %s: want an error", test.id, test.state)
+		}
+	}
+	if sent := recorder.Transmissions(); len(sent) != 0 {
+		t.Errorf("sent %v for invalid requests", sent)
+	}
+
+	// failed transmissions don't change the state
+	recorder.Err = errors.New("no antenna")
+	if err := SetSwitch("lamp", "on"); err == nil {
+		t.Error("want the transmitter error")
+	}
+	if state, _ := GetState("lamp"); state.State != "" {
+		t.Errorf("state is %q after a failed transmission", state.State)
+	}
+}
+
+func TestValidateSwitches(t *testing.T) {
+	tests := []struct {
+		switches []Switch
+		ok       bool
+	}{
+		{testSwitches, true},
+		{[]Switch{{On: 1, Off: 2}}, false},
+		{[]Switch{{Name: "12", On: 1, Off: 2}}, false},
+		{[]Switch{{Name: "a", On: 1, Off: 2}, {Name: "A", On: 3, Off: 4}}, false},
+		{[]Switch{{Name: "a", On: 1, Off: 1}}, false},
+		{[]Switch{{Name: "a", On: 0, Off: 1}}, false},
+		{[]Switch{{Name: "a", On: 1, Off: 1 << 24}}, false},
+		{[]Switch{{Name: "a", On: 1, Off: 2, Encoding: "morse"}}, false},
+		{[]Switch{{Name: "a", On: 1, Off: 2, Repeat: maxRepeat + 1}}, false},
+	}
+	for i, test := range tests {
+		if err := ValidateSwitches(test.switches); (err == nil) != test.ok {
+			t.Errorf("%d: got error %v, want ok %v", i, err, test.ok)
+		}
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	recorder := setupRecorder(t, testSwitches)
+	q := NewQueue(QueueConfig{})
+	defer q.Close()
+	var results []<-chan error
+	for i := 1; i <= 5; i++ {
+		results = append(results, q.Submit(testSwitches[2], i))
+	}
+	for _, result := range results {
+		if err := <-result; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, sent := range recorder.Transmissions() {
+		if sent.Code != strconv.Itoa(i+1) {
+			t.Errorf("transmission %d: got code %s", i, sent.Code)
+		}
+	}
+}
+
+func TestToggle(t *testing.T) {
+	tests := []struct {
+		state string
+		code  int
+		after string
+	}{
+		// without a known state toggle turns the switch on
+		{"toggle", 1398067, "on"},
+		{"toggle", 1398076, "off"},
+		{"on", 1398067, "on"},
+		{"toggle", 1398076, "off"},
+		{"TOGGLE", 1398067, "on"},
+	}
+	recorder := setupRecorder(t, testSwitches)
+	for i, test := range tests {
+		recorder.Reset()
+		if err := SetSwitch("lamp", test.state); err != nil {
+			t.Fatalf("%d %s: %v", i, test.state, err)
+		}
+		want := Transmission{"raw", decimalToRaw(test.code, Etekcity)}
+		if sent := recorder.Transmissions(); len(sent) != 1 || sent[0] != want {
+			t.Errorf("%d %s: sent %v, want %v", i, test.state, sent, want)
+		}
+		if state, _ := GetState("lamp"); state.State != test.after {
+			t.Errorf("%d %s: state is %q, want %q", i, test.state, state.State, test.after)
+		}
+	}
+}
+
+func TestSetGroup(t *testing.T) {
+	tests := []struct {
+		group string
+		sent  int
+	}{
+		{AllGroup, 3},
+		{"den", 2},
+		{"DEN", 2},
+		{"night", 2},
+	}
+	recorder := setupRecorder(t, testSwitches)
+	if err := SetGroups(map[string][]string{"night": {"lamp", "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		recorder.Reset()
+		if err := SetGroup(test.group, "off"); err != nil {
+			t.Fatalf("%s: %v", test.group, err)
+		}
+		if sent := recorder.Transmissions(); len(sent) != test.sent {
+			t.Errorf("%s: sent %d codes, want %d", test.group, len(sent), test.sent)
+		}
+	}
+	if err := SetGroup("garage", "off"); err == nil {
+		t.Error("unknown group: want an error")
+	}
+}
+
+func TestGroupNames(t *testing.T) {
+	tests := []struct {
+		switches []Switch
+		groups   map[string][]string
+		ok       bool
+	}{
+		{testSwitches, map[string][]string{"night": {"lamp"}}, true},
+		// rooms can't shadow the all group, a configured group or a switch
+		{[]Switch{{Name: "lamp", On: 1, Off: 2, Room: "All"}}, nil, false},
+		{[]Switch{{Name: "lamp", On: 1, Off: 2, Room: " ALL "}}, nil, false},
+		{[]Switch{{Name: "lamp", On: 1, Off: 2, Room: "night"}}, map[string][]string{"night": {"lamp"}}, false},
+		{[]Switch{{Name: "lamp", On: 1, Off: 2, Room: "Fan"}, {Name: "fan", On: 3, Off: 4}}, nil, false},
+		{[]Switch{{Name: "den", On: 1, Off: 2, Room: "den"}}, nil, false},
+		// nor can groups shadow a room or a switch
+		{testSwitches, map[string][]string{"Den": {"lamp"}}, false},
+		{testSwitches, map[string][]string{"heater": {"lamp"}}, false},
+		{testSwitches, map[string][]string{"all": {"lamp"}}, false},
+	}
+	for i, test := range tests {
+		setupRecorder(t, nil)
+		err := SetSwitches(test.switches)
+		if err == nil {
+			err = SetGroups(test.groups)
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%d: got error %v, want ok %v", i, err, test.ok)
+		}
+	}
+
+	// switches can't be renamed over a configured group either
+	setupRecorder(t, testSwitches)
+	if err := SetGroups(map[string][]string{"night": {"lamp"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSwitches([]Switch{{Name: "night", On: 1, Off: 2}}); err == nil {
+		t.Error("switch named after a group: want an error")
+	}
+	if err := SetSwitches([]Switch{{Name: "lamp", On: 1, Off: 2, Room: "Night"}}); err == nil {
+		t.Error("room named after a group: want an error")
+	}
+	if err := SetSwitches([]Switch{{Name: "All", On: 1, Off: 2}}); err == nil {
+		t.Error("switch named all: want an error")
+	}
+
+	// every switch is in the all group exactly once
+	if all := Groups()[AllGroup]; len(all) != len(testSwitches) {
+		t.Errorf("all group is %v", all)
+	}
+}
+
+func TestSwitchHandler(t *testing.T) {
+	tests := []struct {
+		method, url, body string
+		code              int
+		sent              int
+	}{
+		{"GET", "/api/switch", "", http.StatusOK, 0},
+		{"GET", "/api/switch?switch=lamp", "", http.StatusOK, 0},
+		{"GET", "/api/switch?switch=garage", "", http.StatusNotFound, 0},
+		{"GET", "/api/switch?switch=lamp&state=on", "", http.StatusMethodNotAllowed, 0},
+		{"POST", "/api/switch?switch=lamp&state=on", "", http.StatusOK, 1},
+		{"PUT", "/api/switch", `{"switch": 1, "state": "toggle"}`, http.StatusOK, 1},
+		{"POST", "/api/switch", `{"switch": "lamp", "state": "on", "for": "1h"}`, http.StatusOK, 1},
+		{"POST", "/api/switch", `{"switch": "lamp", "state": "on", "for": "soon"}`, http.StatusBadRequest, 0},
+		{"POST", "/api/switch", `{"switch": "lamp"`, http.StatusBadRequest, 0},
+		{"POST", "/api/switch?switch=lamp", "", http.StatusBadRequest, 0},
+		{"POST", "/api/switch?switch=lamp&state=dim", "", http.StatusBadRequest, 0},
+		{"POST", "/api/switch?switch=garage&state=on", "", http.StatusBadRequest, 0},
+		{"DELETE", "/api/switch?switch=lamp", "", http.StatusMethodNotAllowed, 0},
+	}
+	recorder := setupRecorder(t, testSwitches)
+	defer func() {
+		for _, timer := range Timers() {
+			CancelTimer(timer.ID)
+		}
+	}()
+	for _, test := range tests {
+		recorder.Reset()
+		r := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		if test.body != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		SwitchHandler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s %s %s: got %d, want %d: %s", test.method, test.url, test.body, w.Code, test.code, w.Body)
+		}
+		if sent := len(recorder.Transmissions()); sent != test.sent {
+			t.Errorf("%s %s %s: sent %d codes, want %d", test.method, test.url, test.body, sent, test.sent)
+		}
+	}
+}
+
+func TestSwitchesHandler(t *testing.T) {
+	tests := []struct {
+		method, url, body string
+		code              int
+	}{
+		{"GET", "/api/switches", "", http.StatusOK},
+		{"GET", "/api/switches/fan", "", http.StatusOK},
+		{"GET", "/api/switches/2", "", http.StatusOK},
+		{"GET", "/api/switches/garage", "", http.StatusNotFound},
+		{"PUT", "/api/switches/fan", `{"state": "on"}`, http.StatusOK},
+		{"PUT", "/api/switches/fan", `{}`, http.StatusBadRequest},
+		{"PUT", "/api/switches/garage", `{"state": "on"}`, http.StatusNotFound},
+		{"POST", "/api/switches", "", http.StatusMethodNotAllowed},
+		{"DELETE", "/api/switches/fan", "", http.StatusMethodNotAllowed},
+	}
+	setupRecorder(t, testSwitches)
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		SwitchesHandler(w, httptest.NewRequest(test.method, test.url, strings.NewReader(test.body)))
+		if w.Code != test.code {
+			t.Errorf("%s %s: got %d, want %d: %s", test.method, test.url, w.Code, test.code, w.Body)
+		}
+		if w.Code == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+			t.Errorf("%s %s: missing Allow header", test.method, test.url)
+		}
+	}
+}
+
+func TestSwitchRef(t *testing.T) {
+	tests := []struct {
+		json string
+		ref  SwitchRef
+		ok   bool
+	}{
+		{`"lamp"`, "lamp", true},
+		{`2`, "2", true},
+		{`true`, "", false},
+	}
+	for _, test := range tests {
+		var ref SwitchRef
+		err := ref.UnmarshalJSON([]byte(test.json))
+		if (err == nil) != test.ok || ref != test.ref {
+			t.Errorf("%s: got %q, %v", test.json, ref, err)
+		}
+	}
+}
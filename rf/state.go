@@ -0,0 +1,269 @@
+package rf
+
+import (
+	"encoding/json"
+	"fmt"
+	"homeautomation/apihelpers"
+	"homeautomation/filehelpers"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SwitchState is the last state a switch was commanded into. RF outlets
+// don't report back, so this is only what we believe the switch is doing.
+// State is "" when the switch has never been commanded.
+type SwitchState struct {
+	Index   int       `json:"index"`
+	Name    string    `json:"name"`
+	Room    string    `json:"room,omitempty"`
+	State   string    `json:"state"`
+	Changed time.Time `json:"changed"`
+}
+
+// Sources of a state change
+const (
+	SourceTransmitter = "transmitter"
+	SourceRemote      = "remote"
+)
+
+// StateChange is emitted whenever a switch changes state, either because we
+// sent it a code or because its physical remote was used
+type StateChange struct {
+	SwitchState
+	Previous string `json:"previous"`
+	Source   string `json:"source"`
+}
+
+// persisted state of a single switch
+type savedState struct {
+	State   string    `json:"state"`
+	Changed time.Time `json:"changed"`
+}
+
+var (
+	states    = make(map[string]savedState)
+	stateFile string
+	statesMu  sync.RWMutex
+
+	subscribers   = make(map[chan StateChange]bool)
+	subscribersMu sync.Mutex
+	remoteOnce    sync.Once
+)
+
+// LoadState reads the last known switch states from disk and remembers the
+// file so that future changes are persisted to it. A missing file is not an error.
+func LoadState(path string) error {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	stateFile = path
+
+	stateBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]savedState)
+	if err := json.Unmarshal(stateBytes, &loaded); err != nil {
+		return err
+	}
+	states = loaded
+	return nil
+}
+
+// recordState remembers the state a switch was put in by code and notifies
+// subscribers if it changed
+func recordState(s Switch, code int, source string) {
+	state := "on"
+	if code == s.Off {
+		state = "off"
+	}
+	key := strings.ToLower(s.Name)
+
+	statesMu.Lock()
+	previous := states[key].State
+	// remotes repeat their codes: only the first one counts
+	if source == SourceRemote && previous == state {
+		statesMu.Unlock()
+		return
+	}
+	states[key] = savedState{State: state, Changed: time.Now()}
+	if err := saveState(); err != nil {
+		log.Printf("error: could not persist switch state: %q\n", err)
+	}
+	statesMu.Unlock()
+
+	if previous == state {
+		return
+	}
+	index, _, err := FindSwitch(s.Name)
+	if err != nil {
+		return
+	}
+	publish(StateChange{SwitchState: stateOf(index, s), Previous: previous, Source: source})
+}
+
+// Subscribe returns a channel receiving every state change and a function
+// to stop the subscription. Slow subscribers miss changes rather than
+// blocking transmissions.
+func Subscribe() (<-chan StateChange, func()) {
+	ch := make(chan StateChange, 16)
+	subscribersMu.Lock()
+	subscribers[ch] = true
+	subscribersMu.Unlock()
+	return ch, func() {
+		subscribersMu.Lock()
+		defer subscribersMu.Unlock()
+		if subscribers[ch] {
+			delete(subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// send a state change to every subscriber
+func publish(change StateChange) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// trackRemotes updates switch states from codes sent by physical remotes
+func trackRemotes() {
+	remoteOnce.Do(func() {
+		addListener(func(r Received) {
+			for _, s := range Switches() {
+				if s.protocol() != "raw" {
+					continue
+				}
+				// match on the switch's own encoding, which need not be the closest fit
+				encoding, err := LookupEncoding(s.Encoding)
+				if err != nil {
+					continue
+				}
+				code, ok := r.As(encoding.Name)
+				if !ok || (code != s.On && code != s.Off) {
+					continue
+				}
+				log.Printf("action: received code %d from the remote of switch %q\n", code, s.Name)
+				recordState(s, code, SourceRemote)
+			}
+		})
+	})
+}
+
+// write the states to disk. Callers must hold statesMu
+func saveState() error {
+	if stateFile == "" {
+		return nil
+	}
+	return filehelpers.WriteJSON(stateFile, states)
+}
+
+// toggledCode is the code that flips a switch from its last known state.
+// Switches in an unknown state are turned on.
+func toggledCode(s Switch) int {
+	statesMu.RLock()
+	defer statesMu.RUnlock()
+	if states[strings.ToLower(s.Name)].State == "on" {
+		return s.Off
+	}
+	return s.On
+}
+
+// GetState returns the last known state of a switch referenced by index or name
+func GetState(switchID string) (SwitchState, error) {
+	index, s, err := FindSwitch(switchID)
+	if err != nil {
+		return SwitchState{}, err
+	}
+	return stateOf(index, s), nil
+}
+
+// States returns the last known state of every switch
+func States() []SwitchState {
+	all := Switches()
+	result := make([]SwitchState, 0, len(all))
+	for i, s := range all {
+		result = append(result, stateOf(i, s))
+	}
+	return result
+}
+
+func stateOf(index int, s Switch) SwitchState {
+	statesMu.RLock()
+	saved := states[strings.ToLower(s.Name)]
+	statesMu.RUnlock()
+	return SwitchState{
+		Index:   index,
+		Name:    s.Name,
+		Room:    s.Room,
+		State:   saved.State,
+		Changed: saved.Changed,
+	}
+}
+
+// StatesHandler is an HTTP Handler that returns the last known state of every switch
+func StatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	apihelpers.EncodeJSON(w, http.StatusOK, States())
+}
+
+// stateHandler returns the last known state of a single switch
+func stateHandler(w http.ResponseWriter, r *http.Request, switchID string) {
+	state, err := GetState(switchID)
+	if err != nil {
+		apihelpers.EncodeError(w, http.StatusNotFound, "Invalid Switch Number or Name")
+		return
+	}
+	apihelpers.EncodeJSON(w, http.StatusOK, state)
+}
+
+// EventsHandler is an HTTP Handler that streams state changes as they happen
+// as server-sent events, each a "state" event with a JSON StateChange
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apihelpers.EncodeError(w, http.StatusInternalServerError, "Streaming Not Supported")
+		return
+	}
+
+	changes, stop := Subscribe()
+	defer stop()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case change := <-changes:
+			changeBytes, err := json.Marshal(change)
+			if err != nil {
+				log.Printf("error: could not encode state change: %q\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", changeBytes)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package rf
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a temporary directory removed at the end of the test
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestLoadState(t *testing.T) {
+	setupRecorder(t, []Switch{{Name: "Lamp", On: 1, Off: 2}, {Name: "fan", On: 3, Off: 4}})
+	path := filepath.Join(tempDir(t), "state.json")
+	defer func() { stateFile = "" }()
+
+	// a missing file is fine
+	if err := LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSwitch("lamp", "on"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSwitch("fan", "off"); err != nil {
+		t.Fatal(err)
+	}
+	before := States()
+
+	// forget everything and read it back as after a restart
+	statesMu.Lock()
+	states = make(map[string]savedState)
+	statesMu.Unlock()
+	if err := LoadState(path); err != nil {
+		t.Fatal(err)
+	}
+	after := States()
+	for i := range before {
+		if after[i].State != before[i].State || !after[i].Changed.Equal(before[i].Changed) {
+			t.Errorf("switch %d: got %+v, want %+v", i, after[i], before[i])
+		}
+	}
+	if after[0].State != "on" || after[1].State != "off" {
+		t.Errorf("got states %+v", after)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadState(path); err == nil {
+		t.Error("corrupt state file: want an error")
+	}
+	if state, _ := GetState("lamp"); state.State != "on" {
+		t.Errorf("a corrupt file replaced the states: got %+v", state)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	setupRecorder(t, []Switch{{Name: "lamp", On: 1, Off: 2}})
+	server := httptest.NewServer(http.HandlerFunc(EventsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %q", ct)
+	}
+
+	// the subscription exists once the headers are sent
+	if err := SetSwitch("lamp", "on"); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); line != "event: state\n" {
+		t.Fatalf("got %q, want a state event", line)
+	}
+	line, _ := reader.ReadString('\n')
+	change := StateChange{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &change); err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	if change.Name != "lamp" || change.State != "on" || change.Source != SourceTransmitter {
+		t.Errorf("got %+v", change)
+	}
+}
+
+func TestEventsHandlerMethod(t *testing.T) {
+	w := httptest.NewRecorder()
+	EventsHandler(w, httptest.NewRequest("POST", "/api/events", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d, want 405", w.Code)
+	}
+}
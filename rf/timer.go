@@ -0,0 +1,241 @@
+package rf
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"homeautomation/apihelpers"
+	"homeautomation/filehelpers"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timer sets a switch to a state once its deadline passes, e.g. to turn a
+// switch back off after it was turned on for a while
+type Timer struct {
+	ID       string    `json:"id"`
+	Switch   string    `json:"switch"`
+	State    string    `json:"state"`
+	Deadline time.Time `json:"deadline"`
+}
+
+var (
+	timers    = make(map[string]*pendingTimer)
+	timerFile string
+	timersMu  sync.Mutex
+)
+
+// a timer that is waiting for its deadline
+type pendingTimer struct {
+	Timer
+	timer *time.Timer
+}
+
+// LoadTimers restores the pending timers from disk and remembers the file so
+// that future timers are persisted to it. Timers whose deadline passed while
+// we were down fire right away. A missing file is not an error.
+func LoadTimers(path string) error {
+	timersMu.Lock()
+	defer timersMu.Unlock()
+	timerFile = path
+
+	timerBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var loaded []Timer
+	if err := json.Unmarshal(timerBytes, &loaded); err != nil {
+		return err
+	}
+	for _, t := range loaded {
+		if _, _, err := FindSwitch(t.Switch); err != nil {
+			log.Printf("error: dropping timer %q: %q\n", t.ID, err)
+			continue
+		}
+		arm(t)
+	}
+	return saveTimers()
+}
+
+// SetSwitchFor sets a switch to a state and starts a timer that sets it to
+// the opposite state after d. A pending timer for the same switch is replaced.
+func SetSwitchFor(switchID, state string, d time.Duration) (Timer, error) {
+	if d <= 0 {
+		return Timer{}, errors.New("error: duration must be positive")
+	}
+	if err := SetSwitch(switchID, state); err != nil {
+		return Timer{}, err
+	}
+	current, err := GetState(switchID)
+	if err != nil {
+		return Timer{}, err
+	}
+	revert := "off"
+	if current.State == "off" {
+		revert = "on"
+	}
+	return StartTimer(current.Name, revert, d)
+}
+
+// StartTimer sets a switch to a state after d. A pending timer for the same
+// switch is replaced.
+func StartTimer(switchID, state string, d time.Duration) (Timer, error) {
+	_, s, err := FindSwitch(switchID)
+	if err != nil {
+		return Timer{}, err
+	}
+	if !ValidState(state) {
+		return Timer{}, errors.New("error: invalid state: " + state)
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return Timer{}, err
+	}
+	t := Timer{
+		ID:       hex.EncodeToString(b),
+		Switch:   s.Name,
+		State:    strings.ToLower(state),
+		Deadline: time.Now().Add(d),
+	}
+
+	timersMu.Lock()
+	defer timersMu.Unlock()
+	stopTimers(s.Name)
+	arm(t)
+	if err := saveTimers(); err != nil {
+		log.Printf("error: could not persist timers: %q\n", err)
+	}
+	return t, nil
+}
+
+// CancelTimer stops a pending timer
+func CancelTimer(id string) error {
+	timersMu.Lock()
+	defer timersMu.Unlock()
+	pending, ok := timers[id]
+	if !ok {
+		return errors.New("error: unknown timer: " + id)
+	}
+	pending.timer.Stop()
+	delete(timers, id)
+	return saveTimers()
+}
+
+// cancelTimers stops the pending timers of a switch: a state set explicitly
+// supersedes whatever a timer was going to do
+func cancelTimers(switchName string) {
+	timersMu.Lock()
+	defer timersMu.Unlock()
+	if !stopTimers(switchName) {
+		return
+	}
+	log.Printf("action: cancelled the timer of switch %q\n", switchName)
+	if err := saveTimers(); err != nil {
+		log.Printf("error: could not persist timers: %q\n", err)
+	}
+}
+
+// stop and forget the pending timers of a switch, reporting whether there
+// were any. Callers must hold timersMu
+func stopTimers(switchName string) bool {
+	stopped := false
+	for id, pending := range timers {
+		if strings.EqualFold(pending.Switch, switchName) {
+			pending.timer.Stop()
+			delete(timers, id)
+			stopped = true
+		}
+	}
+	return stopped
+}
+
+// Timers returns the pending timers, soonest first
+func Timers() []Timer {
+	timersMu.Lock()
+	defer timersMu.Unlock()
+	result := make([]Timer, 0, len(timers))
+	for _, pending := range timers {
+		result = append(result, pending.Timer)
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].Deadline.Before(result[b].Deadline) })
+	return result
+}
+
+// start waiting for a timer's deadline. Callers must hold timersMu
+func arm(t Timer) {
+	pending := &pendingTimer{Timer: t}
+	pending.timer = time.AfterFunc(time.Until(t.Deadline), func() { fire(t.ID) })
+	timers[t.ID] = pending
+}
+
+// a timer's deadline passed: set its switch
+func fire(id string) {
+	timersMu.Lock()
+	pending, ok := timers[id]
+	if !ok {
+		timersMu.Unlock()
+		return
+	}
+	delete(timers, id)
+	if err := saveTimers(); err != nil {
+		log.Printf("error: could not persist timers: %q\n", err)
+	}
+	timersMu.Unlock()
+
+	// not SetSwitch: that would cancel a timer started in the meantime
+	log.Printf("action: timer turning switch %q %s\n", pending.Switch, pending.State)
+	job, err := switchJob(pending.Switch, pending.State)
+	if err == nil {
+		err = <-getQueue().submit(job)
+	}
+	if err != nil {
+		log.Printf("error: timer could not turn switch %q %s: %q\n", pending.Switch, pending.State, err)
+	}
+}
+
+// write the pending timers to disk. Callers must hold timersMu
+func saveTimers() error {
+	if timerFile == "" {
+		return nil
+	}
+	pending := make([]Timer, 0, len(timers))
+	for _, t := range timers {
+		pending = append(pending, t.Timer)
+	}
+	sort.Slice(pending, func(a, b int) bool { return pending[a].ID < pending[b].ID })
+	return filehelpers.WriteJSON(timerFile, pending)
+}
+
+// TimersHandler is an HTTP Handler for pending timers.
+// GET /api/timers lists the pending timers
+// DELETE /api/timers/{id} cancels a timer
+func TimersHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/timers"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			apihelpers.EncodeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		apihelpers.EncodeJSON(w, http.StatusOK, Timers())
+		return
+	}
+	if r.Method != http.MethodDelete {
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodDelete)
+		return
+	}
+	if err := CancelTimer(id); err != nil {
+		apihelpers.EncodeError(w, http.StatusNotFound, "Invalid Timer")
+		return
+	}
+	apihelpers.EncodeJSON(w, http.StatusOK, map[string]string{"message": "Successfully cancelled timer " + id})
+}
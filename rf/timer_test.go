@@ -0,0 +1,225 @@
+package rf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stop and forget every pending timer. Callers must hold timersMu
+func stopAllTimers() {
+	for id, pending := range timers {
+		pending.timer.Stop()
+		delete(timers, id)
+	}
+}
+
+// wait for a switch to reach a state
+func waitForState(t *testing.T, switchID, want string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if state, _ := GetState(switchID); state.State == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			state, _ := GetState(switchID)
+			t.Fatalf("switch %s is %q, want %q", switchID, state.State, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSetSwitchFor(t *testing.T) {
+	recorder := setupRecorder(t, testSwitches)
+	timer, err := SetSwitchFor("lamp", "on", 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timer.Switch != "lamp" || timer.State != "off" {
+		t.Errorf("got timer %+v", timer)
+	}
+	if pending := Timers(); len(pending) != 1 || pending[0].ID != timer.ID {
+		t.Errorf("got timers %+v", pending)
+	}
+	waitForState(t, "lamp", "off")
+	if pending := Timers(); len(pending) != 0 {
+		t.Errorf("timer still pending after firing: %+v", pending)
+	}
+	if sent := recorder.Transmissions(); len(sent) != 2 {
+		t.Errorf("sent %v, want on then off", sent)
+	}
+
+	// a switch that was off is turned back on
+	if _, err := SetSwitchFor("fan", "toggle", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if timer, err = SetSwitchFor("fan", "off", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if pending := Timers(); len(pending) != 1 || timer.State != "on" {
+		t.Errorf("got timers %+v, want a single one turning the fan on", pending)
+	}
+	if _, err := SetSwitchFor("fan", "on", 0); err == nil {
+		t.Error("zero duration: want an error")
+	}
+}
+
+func TestSetCancelsTimer(t *testing.T) {
+	recorder := setupRecorder(t, testSwitches)
+	tests := []struct {
+		name string
+		set  func() error
+	}{
+		{"switch", func() error { return SetSwitch("lamp", "off") }},
+		{"async switch", func() error { return SetSwitchAsync("lamp", "off") }},
+		{"room", func() error { return SetGroup("den", "off") }},
+		{"all", func() error { return SetGroupAsync(AllGroup, "off") }},
+	}
+	for _, test := range tests {
+		if _, err := SetSwitchFor("lamp", "on", 30*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.set(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if pending := Timers(); len(pending) != 0 {
+			t.Errorf("%s: timers still pending: %+v", test.name, pending)
+		}
+		waitForState(t, "lamp", "off")
+	}
+
+	// on for a while, off, then on again: the old timer doesn't turn it off
+	recorder.Reset()
+	if _, err := SetSwitchFor("lamp", "on", 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSwitch("lamp", "off"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSwitch("lamp", "on"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if state, _ := GetState("lamp"); state.State != "on" {
+		t.Errorf("lamp is %q, want on", state.State)
+	}
+	if sent := recorder.Transmissions(); len(sent) != 3 {
+		t.Errorf("sent %d codes, want 3", len(sent))
+	}
+
+	// a timer on another switch is left alone
+	if _, err := SetSwitchFor("heater", "on", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSwitch("lamp", "off"); err != nil {
+		t.Fatal(err)
+	}
+	if pending := Timers(); len(pending) != 1 {
+		t.Errorf("got timers %+v, want the heater's", pending)
+	}
+}
+
+func TestLoadTimers(t *testing.T) {
+	setupRecorder(t, testSwitches)
+	path := filepath.Join(tempDir(t), "timers.json")
+	defer func() {
+		timersMu.Lock()
+		stopAllTimers()
+		timerFile = ""
+		timersMu.Unlock()
+	}()
+
+	// a missing file is fine
+	if err := LoadTimers(path); err != nil {
+		t.Fatal(err)
+	}
+	started, err := StartTimer("lamp", "off", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// forget the timers and restore them as after a restart
+	timersMu.Lock()
+	stopAllTimers()
+	timersMu.Unlock()
+	if err := LoadTimers(path); err != nil {
+		t.Fatal(err)
+	}
+	pending := Timers()
+	if len(pending) != 1 || pending[0].ID != started.ID || !pending[0].Deadline.Equal(started.Deadline) {
+		t.Errorf("got timers %+v, want %+v", pending, started)
+	}
+
+	// timers that expired while we were down fire right away; timers of
+	// switches that no longer exist are dropped
+	timersMu.Lock()
+	stopAllTimers()
+	timersMu.Unlock()
+	saved := []Timer{
+		{ID: "expired", Switch: "fan", State: "on", Deadline: time.Now().Add(-time.Minute)},
+		{ID: "gone", Switch: "garage", State: "on", Deadline: time.Now().Add(time.Hour)},
+	}
+	timerBytes, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, timerBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadTimers(path); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, "fan", "on")
+	if pending := Timers(); len(pending) != 0 {
+		t.Errorf("got timers %+v", pending)
+	}
+	timerBytes, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var persisted []Timer
+	if err := json.Unmarshal(timerBytes, &persisted); err != nil || len(persisted) != 0 {
+		t.Errorf("persisted %s", timerBytes)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadTimers(path); err == nil {
+		t.Error("corrupt timer file: want an error")
+	}
+}
+
+func TestTimersHandler(t *testing.T) {
+	setupRecorder(t, testSwitches)
+	timer, err := StartTimer("lamp", "off", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, url string
+		code        int
+		pending     int
+	}{
+		{"GET", "/api/timers", http.StatusOK, 1},
+		{"POST", "/api/timers", http.StatusMethodNotAllowed, 1},
+		{"GET", "/api/timers/" + timer.ID, http.StatusMethodNotAllowed, 1},
+		{"DELETE", "/api/timers/missing", http.StatusNotFound, 1},
+		{"DELETE", "/api/timers/" + timer.ID, http.StatusOK, 0},
+		{"DELETE", "/api/timers/" + timer.ID, http.StatusNotFound, 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		TimersHandler(w, httptest.NewRequest(test.method, test.url, nil))
+		if w.Code != test.code {
+			t.Errorf("%s %s: got %d, want %d: %s", test.method, test.url, w.Code, test.code, w.Body)
+		}
+		if pending := len(Timers()); pending != test.pending {
+			t.Errorf("%s %s: %d timers pending, want %d", test.method, test.url, pending, test.pending)
+		}
+	}
+}
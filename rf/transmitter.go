@@ -0,0 +1,132 @@
+package rf
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transmitter sends a code over the air using the given pilight protocol
+type Transmitter interface {
+	Transmit(protocol, code string) error
+}
+
+// TransmitterConfig describes which transmitter backend to use
+// Type (string): "exec | socket | recorder"
+type TransmitterConfig struct {
+	Type string `json:"type"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// NewTransmitter creates the transmitter described by the config.
+// Missing values default to the pilight-send executable talking to
+// the daemon on 127.0.0.1:5000.
+func NewTransmitter(c TransmitterConfig) (Transmitter, error) {
+	if c.Host == "" {
+		c.Host = "127.0.0.1"
+	}
+	if c.Port == 0 {
+		c.Port = 5000
+	}
+	switch c.Type {
+	case "", "exec":
+		return &ExecTransmitter{Host: c.Host, Port: c.Port}, nil
+	case "socket":
+		return NewPilightClient(net.JoinHostPort(c.Host, strconv.Itoa(c.Port))), nil
+	case "recorder":
+		return &Recorder{}, nil
+	}
+	return nil, fmt.Errorf("error: unknown transmitter type: %q", c.Type)
+}
+
+var (
+	transmitter   Transmitter = &ExecTransmitter{Host: "127.0.0.1", Port: 5000}
+	transmitterMu sync.RWMutex
+)
+
+// SetTransmitter replaces the transmitter used to send codes
+func SetTransmitter(t Transmitter) {
+	transmitterMu.Lock()
+	defer transmitterMu.Unlock()
+	transmitter = t
+}
+
+// getTransmitter returns the transmitter currently in use
+func getTransmitter() Transmitter {
+	transmitterMu.RLock()
+	defer transmitterMu.RUnlock()
+	return transmitter
+}
+
+// ----------------------------------------------------------------------------
+// pilight-send executable
+// ----------------------------------------------------------------------------
+
+// ExecTransmitter executes the External "pilight-send" command for every code
+type ExecTransmitter struct {
+	Host string
+	Port int
+}
+
+// Transmit runs pilight-send against the configured pilight daemon
+func (e *ExecTransmitter) Transmit(protocol, code string) error {
+	pilightArgs := []string{"-S", e.Host, "-P", strconv.Itoa(e.Port), "-p", protocol, "-c", code}
+	cmd := exec.Command("pilight-send", pilightArgs...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("pilight-send failed: %s", msg)
+		}
+		return fmt.Errorf("pilight-send failed: %v", err)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// In-memory recorder
+// ----------------------------------------------------------------------------
+
+// Transmission is a code that was handed to a transmitter
+type Transmission struct {
+	Protocol string
+	Code     string
+}
+
+// Recorder is a Transmitter that remembers every code instead of sending it.
+// Setting Err makes every subsequent Transmit fail with that error.
+type Recorder struct {
+	Err           error
+	mu            sync.Mutex
+	transmissions []Transmission
+}
+
+// Transmit records the code
+func (r *Recorder) Transmit(protocol, code string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Err != nil {
+		return r.Err
+	}
+	r.transmissions = append(r.transmissions, Transmission{Protocol: protocol, Code: code})
+	return nil
+}
+
+// Transmissions returns a copy of everything recorded so far
+func (r *Recorder) Transmissions() []Transmission {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := make([]Transmission, len(r.transmissions))
+	copy(t, r.transmissions)
+	return t
+}
+
+// Reset forgets all recorded transmissions
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transmissions = nil
+}
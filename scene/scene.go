@@ -0,0 +1,192 @@
+package scene
+
+import (
+	"errors"
+	"fmt"
+	"homeautomation/apihelpers"
+	"homeautomation/rf"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Step sets a switch (or a group of switches) to a state after an optional delay
+type Step struct {
+	Switch string `json:"switch,omitempty"`
+	Group  string `json:"group,omitempty"`
+	State  string `json:"state"`
+	Delay  string `json:"delay,omitempty"`
+	delay  time.Duration
+}
+
+// StepResult reports how a step of a scene went
+type StepResult struct {
+	Step
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+var (
+	scenes   = make(map[string][]Step)
+	scenesMu sync.RWMutex
+)
+
+// SetScenes validates and installs the named scenes
+func SetScenes(s map[string][]Step) error {
+	installed := make(map[string][]Step, len(s))
+	for name, steps := range s {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if key == "" {
+			return errors.New("error: scene: missing name")
+		}
+		if len(steps) == 0 {
+			return fmt.Errorf("error: scene %q has no steps", name)
+		}
+		validated := make([]Step, len(steps))
+		for i, step := range steps {
+			if err := validateStep(&step); err != nil {
+				return fmt.Errorf("error: scene %q: step %d: %v", name, i, err)
+			}
+			validated[i] = step
+		}
+		installed[key] = validated
+	}
+	scenesMu.Lock()
+	defer scenesMu.Unlock()
+	scenes = installed
+	return nil
+}
+
+// make sure a step references something real and parse its delay
+func validateStep(step *Step) error {
+	switch {
+	case step.Switch != "" && step.Group != "":
+		return errors.New("a step sets either a switch or a group")
+	case step.Switch != "":
+		if _, _, err := rf.FindSwitch(step.Switch); err != nil {
+			return err
+		}
+	case step.Group != "":
+		if _, err := rf.FindGroup(step.Group); err != nil {
+			return err
+		}
+	default:
+		return errors.New("missing switch or group")
+	}
+	if !rf.ValidState(step.State) {
+		return fmt.Errorf("invalid state %q", step.State)
+	}
+	if step.Delay != "" {
+		delay, err := time.ParseDuration(step.Delay)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("invalid delay %q", step.Delay)
+		}
+		step.delay = delay
+	}
+	return nil
+}
+
+// Names returns the names of every scene
+func Names() []string {
+	scenesMu.RLock()
+	defer scenesMu.RUnlock()
+	names := make([]string, 0, len(scenes))
+	for name := range scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Exists reports whether a scene has been defined
+func Exists(name string) bool {
+	scenesMu.RLock()
+	defer scenesMu.RUnlock()
+	_, ok := scenes[strings.ToLower(strings.TrimSpace(name))]
+	return ok
+}
+
+// Run executes the steps of a scene in order, waiting for each step's delay
+// before it. A failing step doesn't stop the scene.
+func Run(name string) ([]StepResult, error) {
+	scenesMu.RLock()
+	steps, ok := scenes[strings.ToLower(strings.TrimSpace(name))]
+	scenesMu.RUnlock()
+	if !ok {
+		return nil, errors.New("error: unknown scene: " + name)
+	}
+
+	log.Printf("action: running scene %q\n", name)
+	results := make([]StepResult, 0, len(steps))
+	for _, step := range steps {
+		if step.delay > 0 {
+			time.Sleep(step.delay)
+		}
+		var err error
+		if step.Group != "" {
+			err = rf.SetGroup(step.Group, step.State)
+		} else {
+			err = rf.SetSwitch(step.Switch, step.State)
+		}
+		result := StepResult{Step: step, Success: err == nil}
+		if err != nil {
+			log.Printf("error: scene %q: could not set %s%s %s: %q\n", name, step.Switch, step.Group, step.State, err)
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Failed reports whether any step of a scene failed
+func Failed(results []StepResult) bool {
+	for _, result := range results {
+		if !result.Success {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler is an HTTP Handler for scenes.
+// GET /api/scene/ lists the scenes
+// POST /api/scene/{name} runs a scene and reports how each step went
+func Handler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/scene"), "/")
+	if name == "" {
+		if r.Method != http.MethodGet {
+			apihelpers.EncodeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		apihelpers.EncodeJSON(w, http.StatusOK, Names())
+		return
+	}
+	if r.Method != http.MethodPost {
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !Exists(name) {
+		apihelpers.EncodeError(w, http.StatusNotFound, "Invalid Scene")
+		return
+	}
+
+	results, err := Run(name)
+	if err != nil {
+		apihelpers.EncodeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if Failed(results) {
+		apihelpers.EncodeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"error": "Some steps of scene " + name + " failed",
+			"steps": results,
+		})
+		return
+	}
+	apihelpers.EncodeJSON(w, http.StatusOK, map[string]interface{}{
+		"message": "Successfully ran scene " + name,
+		"steps":   results,
+	})
+}
@@ -0,0 +1,189 @@
+package scene
+
+import (
+	"errors"
+	"homeautomation/rf"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyRecorder records codes like rf.Recorder but fails the ones sent with
+// its protocol
+type flakyRecorder struct {
+	*rf.Recorder
+	protocol string
+}
+
+func (f *flakyRecorder) Transmit(protocol, code string) error {
+	if protocol == f.protocol {
+		return errors.New("no antenna")
+	}
+	return f.Recorder.Transmit(protocol, code)
+}
+
+// send codes to a recorder for a few switches. The "broken" switch always
+// fails to transmit.
+func setupScenes(t *testing.T, s map[string][]Step) *rf.Recorder {
+	recorder := &rf.Recorder{}
+	rf.SetTransmitter(&flakyRecorder{Recorder: recorder, protocol: "broken"})
+	rf.SetQueue(rf.NewQueue(rf.QueueConfig{}))
+	err := rf.SetSwitches([]rf.Switch{
+		{Name: "lamp", On: 1, Off: 2, Protocol: "arctech_switch", Room: "den"},
+		{Name: "fan", On: 3, Off: 4, Protocol: "arctech_switch", Room: "den"},
+		{Name: "porch", On: 5, Off: 6, Protocol: "arctech_switch"},
+		{Name: "broken", On: 7, Off: 8, Protocol: "broken"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.SetGroups(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetScenes(s); err != nil {
+		t.Fatal(err)
+	}
+	return recorder
+}
+
+// the codes sent to the recorder
+func sentCodes(recorder *rf.Recorder) string {
+	var codes []string
+	for _, sent := range recorder.Transmissions() {
+		codes = append(codes, sent.Code)
+	}
+	return strings.Join(codes, " ")
+}
+
+func TestRunOrder(t *testing.T) {
+	recorder := setupScenes(t, map[string][]Step{
+		"Evening": {
+			{Switch: "porch", State: "on"},
+			{Group: "den", State: "off"},
+			{Switch: "lamp", State: "on"},
+		},
+	})
+	results, err := Run("evening")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Failed(results) || len(results) != 3 {
+		t.Errorf("got results %+v", results)
+	}
+	if codes := sentCodes(recorder); codes != "5 2 4 1" {
+		t.Errorf("sent %q, want %q", codes, "5 2 4 1")
+	}
+	if _, err := Run("morning"); err == nil {
+		t.Error("unknown scene: want an error")
+	}
+}
+
+func TestRunDelay(t *testing.T) {
+	const delay = 30 * time.Millisecond
+	recorder := setupScenes(t, map[string][]Step{
+		"slow": {
+			{Switch: "lamp", State: "on"},
+			{Switch: "fan", State: "on", Delay: delay.String()},
+			{Switch: "porch", State: "on", Delay: delay.String()},
+		},
+	})
+	start := time.Now()
+	if _, err := Run("slow"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("scene took %s, want at least %s", elapsed, 2*delay)
+	}
+	if codes := sentCodes(recorder); codes != "1 3 5" {
+		t.Errorf("sent %q, want %q", codes, "1 3 5")
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	recorder := setupScenes(t, map[string][]Step{
+		"night": {
+			{Switch: "lamp", State: "off"},
+			{Switch: "broken", State: "off"},
+			{Switch: "porch", State: "off"},
+		},
+	})
+	results, err := Run("night")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Failed(results) {
+		t.Error("Failed: got false, want true")
+	}
+	for i, want := range []bool{true, false, true} {
+		if results[i].Success != want || (results[i].Error == "") != want {
+			t.Errorf("step %d: got %+v", i, results[i])
+		}
+	}
+	// a failing step doesn't stop the scene
+	if codes := sentCodes(recorder); codes != "2 6" {
+		t.Errorf("sent %q, want %q", codes, "2 6")
+	}
+}
+
+func TestSetScenes(t *testing.T) {
+	tests := []struct {
+		steps []Step
+		ok    bool
+	}{
+		{[]Step{{Switch: "lamp", State: "on"}, {Group: "all", State: "toggle", Delay: "1s"}}, true},
+		{[]Step{{Switch: "1", State: "off"}}, true},
+		{nil, false},
+		{[]Step{{Switch: "garage", State: "on"}}, false},
+		{[]Step{{Switch: "9", State: "on"}}, false},
+		{[]Step{{Group: "attic", State: "on"}}, false},
+		{[]Step{{Switch: "lamp", Group: "den", State: "on"}}, false},
+		{[]Step{{State: "on"}}, false},
+		{[]Step{{Switch: "lamp", State: "dim"}}, false},
+		{[]Step{{Switch: "lamp", State: "on", Delay: "soon"}}, false},
+		{[]Step{{Switch: "lamp", State: "on", Delay: "-1s"}}, false},
+	}
+	setupScenes(t, nil)
+	for i, test := range tests {
+		err := SetScenes(map[string][]Step{"test": test.steps})
+		if (err == nil) != test.ok {
+			t.Errorf("%d: got error %v, want ok %v", i, err, test.ok)
+		}
+	}
+	if err := SetScenes(map[string][]Step{" ": {{Switch: "lamp", State: "on"}}}); err == nil {
+		t.Error("unnamed scene: want an error")
+	}
+
+	// a rejected set of scenes leaves the installed ones alone
+	setupScenes(t, map[string][]Step{"evening": {{Switch: "lamp", State: "on"}}})
+	SetScenes(map[string][]Step{"night": {{Switch: "garage", State: "off"}}})
+	if !Exists("Evening") || Exists("night") {
+		t.Errorf("got scenes %v after a rejected update", Names())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		method, url string
+		code        int
+	}{
+		{"GET", "/api/scene/", http.StatusOK},
+		{"POST", "/api/scene/", http.StatusMethodNotAllowed},
+		{"POST", "/api/scene/evening", http.StatusOK},
+		{"POST", "/api/scene/night", http.StatusInternalServerError},
+		{"POST", "/api/scene/morning", http.StatusNotFound},
+		{"GET", "/api/scene/evening", http.StatusMethodNotAllowed},
+	}
+	setupScenes(t, map[string][]Step{
+		"evening": {{Switch: "lamp", State: "on"}},
+		"night":   {{Switch: "broken", State: "off"}},
+	})
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		Handler(w, httptest.NewRequest(test.method, test.url, nil))
+		if w.Code != test.code {
+			t.Errorf("%s %s: got %d, want %d: %s", test.method, test.url, w.Code, test.code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"0 7 * * 1-5", true},
+		{"*/15 6-22 * * *", true},
+		{"0,30 8 1,15 */2 0", true},
+		{"1-30/5 * * * 7", true},
+		{"@daily", true},
+		{"@HOURLY", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"@sometimes", false},
+	}
+	for _, test := range tests {
+		if _, err := ParseCron(test.expr); (err == nil) != test.ok {
+			t.Errorf("%q: got error %v, want ok %v", test.expr, err, test.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a Wednesday
+	from := time.Date(2024, time.January, 10, 12, 34, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 10, 12, 35, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 10, 12, 45, 0, 0, time.UTC)},
+		{"34 12 * * *", time.Date(2024, time.January, 11, 12, 34, 0, 0, time.UTC)},
+		{"0 7 * * 1-5", time.Date(2024, time.January, 11, 7, 0, 0, 0, time.UTC)},
+		{"0 9 * * 0", time.Date(2024, time.January, 14, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2024, time.January, 14, 9, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// day of month or day of week when both are restricted
+		{"0 0 20 * 5", time.Date(2024, time.January, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", test.expr, err)
+		}
+		if got := c.Next(from); !got.Equal(test.want) {
+			t.Errorf("%q: got %s, want %s", test.expr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package schedule
+
+import (
+	"encoding/json"
+	"homeautomation/apihelpers"
+	"net/http"
+	"strings"
+)
+
+// Handler is an HTTP Handler for managing scheduled jobs.
+// GET /api/schedules lists every job
+// POST /api/schedules creates a job from a JSON body
+// GET /api/schedules/{id} returns a job
+// PUT /api/schedules/{id} replaces a job with a JSON body
+// DELETE /api/schedules/{id} removes a job
+func (s *Scheduler) Handler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/schedules"), "/")
+
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			apihelpers.EncodeJSON(w, http.StatusOK, s.List())
+		case http.MethodPost:
+			j, ok := decodeJob(w, r)
+			if !ok {
+				return
+			}
+			created, err := s.Add(j)
+			if err != nil {
+				apihelpers.EncodeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			apihelpers.EncodeJSON(w, http.StatusCreated, created)
+		default:
+			apihelpers.EncodeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+		return
+	}
+
+	if _, ok := s.Get(id); !ok {
+		apihelpers.EncodeError(w, http.StatusNotFound, "Invalid Schedule")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		j, _ := s.Get(id)
+		apihelpers.EncodeJSON(w, http.StatusOK, j)
+	case http.MethodPut:
+		j, ok := decodeJob(w, r)
+		if !ok {
+			return
+		}
+		updated, err := s.Update(id, j)
+		if err != nil {
+			apihelpers.EncodeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		apihelpers.EncodeJSON(w, http.StatusOK, updated)
+	case http.MethodDelete:
+		if err := s.Remove(id); err != nil {
+			apihelpers.EncodeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		apihelpers.EncodeJSON(w, http.StatusOK, map[string]string{"message": "Successfully removed schedule " + id})
+	default:
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// decode a job from the request body, responding with an error if it's invalid
+func decodeJob(w http.ResponseWriter, r *http.Request) (Job, bool) {
+	j := Job{}
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid JSON Body")
+		return j, false
+	}
+	return j, true
+}
@@ -0,0 +1,406 @@
+package schedule
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homeautomation/filehelpers"
+	"homeautomation/rf"
+	"homeautomation/scene"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Action is what a job does when it runs: set a switch, a group or run a scene
+type Action struct {
+	Switch string `json:"switch,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Scene  string `json:"scene,omitempty"`
+	State  string `json:"state,omitempty"`
+}
+
+// Job is a scheduled action. A job either repeats following a cron
+// expression, repeats daily relative to a solar event or runs once at a
+// given time, after which it is removed.
+type Job struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Cron      string     `json:"cron,omitempty"`
+	Solar     *Solar     `json:"solar,omitempty"`
+	At        *time.Time `json:"at,omitempty"`
+	Action    Action     `json:"action"`
+	Next      time.Time  `json:"next"`
+	LastRun   *time.Time `json:"lastRun,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+	cron      *Cron
+}
+
+// Validate makes sure the action references something that exists
+func (a Action) Validate() error {
+	targets := 0
+	for _, target := range []string{a.Switch, a.Group, a.Scene} {
+		if target != "" {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return errors.New("error: an action needs exactly one of switch, group or scene")
+	}
+	switch {
+	case a.Scene != "":
+		if !scene.Exists(a.Scene) {
+			return errors.New("error: unknown scene: " + a.Scene)
+		}
+		return nil
+	case a.Switch != "":
+		if _, _, err := rf.FindSwitch(a.Switch); err != nil {
+			return err
+		}
+	case a.Group != "":
+		if _, err := rf.FindGroup(a.Group); err != nil {
+			return err
+		}
+	}
+	if !rf.ValidState(a.State) {
+		return fmt.Errorf("error: invalid state %q", a.State)
+	}
+	return nil
+}
+
+// Run performs the action
+func (a Action) Run() error {
+	switch {
+	case a.Scene != "":
+		results, err := scene.Run(a.Scene)
+		if err != nil {
+			return err
+		}
+		if scene.Failed(results) {
+			return errors.New("error: some steps of scene " + a.Scene + " failed")
+		}
+		return nil
+	case a.Group != "":
+		return rf.SetGroup(a.Group, a.State)
+	}
+	return rf.SetSwitch(a.Switch, a.State)
+}
+
+// String describes the action for the logs
+func (a Action) String() string {
+	switch {
+	case a.Scene != "":
+		return "scene " + a.Scene
+	case a.Group != "":
+		return "group " + a.Group + " " + a.State
+	}
+	return "switch " + a.Switch + " " + a.State
+}
+
+// repeats reports whether the job runs more than once
+func (j *Job) repeats() bool {
+	return j.cron != nil || j.Solar != nil
+}
+
+// prepare validates a job and works out when it runs next
+func (j *Job) prepare(now time.Time, l Location) error {
+	if err := j.Action.Validate(); err != nil {
+		return err
+	}
+	kinds := 0
+	for _, set := range []bool{j.Cron != "", j.Solar != nil, j.At != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("error: a job needs exactly one of a cron expression, a solar event or an at time")
+	}
+	switch {
+	case j.Cron != "":
+		c, err := ParseCron(j.Cron)
+		if err != nil {
+			return err
+		}
+		j.cron = c
+	case j.Solar != nil:
+		if !l.configured() {
+			return errors.New("error: solar jobs need a configured location")
+		}
+		if err := j.Solar.prepare(); err != nil {
+			return err
+		}
+	}
+	j.schedule(now, l)
+	return nil
+}
+
+// schedule works out the next run after now
+func (j *Job) schedule(now time.Time, l Location) {
+	switch {
+	case j.cron != nil:
+		j.Next = j.cron.Next(now)
+	case j.Solar != nil:
+		j.Next = j.Solar.Next(now, l)
+	default:
+		j.Next = *j.At
+	}
+}
+
+// Scheduler runs jobs at their scheduled times and persists them to disk
+type Scheduler struct {
+	path     string
+	location Location
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	wake     chan struct{}
+}
+
+// New creates a scheduler whose jobs are persisted in the file at path and
+// whose solar events are computed for the location. Jobs already in the file
+// are loaded; a missing file is not an error. One-shot jobs whose time passed
+// while the server was down are dropped rather than run late.
+func New(path string, l Location) (*Scheduler, error) {
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Scheduler{
+		path:     path,
+		location: l,
+		jobs:     make(map[string]*Job),
+		wake:     make(chan struct{}, 1),
+	}
+	jobBytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	if err := json.Unmarshal(jobBytes, &jobs); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	dropped := false
+	for _, j := range jobs {
+		if j.At != nil && j.At.Before(now) {
+			log.Printf("action: dropping scheduled job %q: it was due at %s\n", j.ID, j.At)
+			dropped = true
+			continue
+		}
+		if err := j.prepare(now, s.location); err != nil {
+			log.Printf("error: dropping scheduled job %q: %q\n", j.ID, err)
+			dropped = true
+			continue
+		}
+		s.jobs[j.ID] = j
+	}
+	if dropped {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// List returns every job, soonest first
+func (s *Scheduler) List() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Next.Before(jobs[b].Next) })
+	return jobs
+}
+
+// Get returns a single job
+func (s *Scheduler) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *j, true
+}
+
+// Add validates and schedules a new job
+func (s *Scheduler) Add(j Job) (Job, error) {
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+	j.ID = id
+	j.LastRun, j.LastError = nil, ""
+	if err := s.validate(&j); err != nil {
+		return Job{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return j, s.put(&j)
+}
+
+// Update replaces an existing job
+func (s *Scheduler) Update(id string, j Job) (Job, error) {
+	j.ID = id
+	if err := s.validate(&j); err != nil {
+		return Job{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.jobs[id]
+	if !ok {
+		return Job{}, errors.New("error: unknown job: " + id)
+	}
+	j.LastRun, j.LastError = existing.LastRun, existing.LastError
+	return j, s.put(&j)
+}
+
+// Remove deletes a job
+func (s *Scheduler) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return errors.New("error: unknown job: " + id)
+	}
+	delete(s.jobs, id)
+	s.signal()
+	return s.save()
+}
+
+// validate a new or changed job and work out when it runs next
+func (s *Scheduler) validate(j *Job) error {
+	now := time.Now()
+	if j.At != nil && j.At.Before(now) {
+		return errors.New("error: at time is in the past")
+	}
+	return j.prepare(now, s.location)
+}
+
+// store a validated job. Callers must hold s.mu
+func (s *Scheduler) put(j *Job) error {
+	s.jobs[j.ID] = j
+	s.signal()
+	return s.save()
+}
+
+// wake the run loop so it picks up changed jobs
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write the jobs to disk. Callers must hold s.mu
+func (s *Scheduler) save() error {
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].ID < jobs[b].ID })
+	return filehelpers.WriteJSON(s.path, jobs)
+}
+
+// Run runs jobs as they become due. It never returns.
+func (s *Scheduler) Run() {
+	for {
+		timer := time.NewTimer(s.untilNext())
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+		timer.Stop()
+		s.runDue(time.Now())
+	}
+}
+
+// how long until the next job is due
+func (s *Scheduler) untilNext() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// check in every now and then even if nothing is scheduled
+	wait := time.Hour
+	for _, j := range s.jobs {
+		if j.Next.IsZero() {
+			continue
+		}
+		if until := j.Next.Sub(time.Now()); until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// run every job that is due and schedule its next run
+func (s *Scheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	var due []*Job
+	for id, j := range s.jobs {
+		if j.Next.IsZero() || j.Next.After(now) {
+			continue
+		}
+		due = append(due, j)
+		if !j.repeats() {
+			delete(s.jobs, id)
+			continue
+		}
+		j.schedule(now, s.location)
+	}
+	if len(due) > 0 {
+		if err := s.save(); err != nil {
+			log.Printf("error: could not persist schedules: %q\n", err)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, j := range due {
+		go s.run(j.ID, j.Action)
+	}
+}
+
+// run a job's action and remember how it went
+func (s *Scheduler) run(id string, a Action) {
+	log.Printf("action: running scheduled job %q: %s\n", id, a)
+	err := a.Run()
+	if err != nil {
+		log.Printf("error: scheduled job %q failed: %q\n", id, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	j.LastRun, j.LastError = &now, ""
+	if err != nil {
+		j.LastError = err.Error()
+	}
+	if err := s.save(); err != nil {
+		log.Printf("error: could not persist schedules: %q\n", err)
+	}
+}
+
+// random job id
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
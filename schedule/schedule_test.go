@@ -0,0 +1,290 @@
+package schedule
+
+import (
+	"encoding/json"
+	"homeautomation/rf"
+	"homeautomation/scene"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a scheduler persisting to a temporary directory with a switch sending
+// codes to a recorder
+func newTestScheduler(t *testing.T) (*Scheduler, *rf.Recorder) {
+	recorder := &rf.Recorder{}
+	rf.SetTransmitter(recorder)
+	rf.SetQueue(rf.NewQueue(rf.QueueConfig{}))
+	if err := rf.SetSwitches([]rf.Switch{{Name: "lamp", On: 1, Off: 2, Protocol: "arctech_switch"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.SetGroups(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := scene.SetScenes(nil); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := New(filepath.Join(dir, "schedules.json"), Location{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, recorder
+}
+
+// wait for the recorder to have sent the codes
+func waitForCodes(t *testing.T, recorder *rf.Recorder, want string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var codes []string
+		for _, sent := range recorder.Transmissions() {
+			codes = append(codes, sent.Code)
+		}
+		if strings.Join(codes, " ") == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %q, want %q", codes, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSchedulerCRUD(t *testing.T) {
+	s, _ := newTestScheduler(t)
+	lightsOut := Job{Name: "lights out", Cron: "30 23 * * *", Action: Action{Switch: "lamp", State: "off"}}
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	once := Job{At: &at, Action: Action{Switch: "lamp", State: "on"}}
+
+	added, err := s.Add(lightsOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.ID == "" || added.Next.IsZero() {
+		t.Errorf("got job %+v", added)
+	}
+	if _, err := s.Add(once); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := s.List(); len(jobs) != 2 || !jobs[0].At.Equal(at) {
+		t.Errorf("got jobs %+v, want the one-shot job first", jobs)
+	}
+
+	invalid := []Job{
+		{Cron: "30 23 * * *", Action: Action{Switch: "garage", State: "off"}},
+		{Cron: "30 23 * * *", Action: Action{Switch: "lamp", State: "dim"}},
+		{Cron: "30 23 * *", Action: Action{Switch: "lamp", State: "off"}},
+		{Action: Action{Switch: "lamp", State: "off"}},
+		{Cron: "30 23 * * *", At: &at, Action: Action{Switch: "lamp", State: "off"}},
+		{Solar: &Solar{Event: Sunset}, Action: Action{Switch: "lamp", State: "off"}},
+		{At: &time.Time{}, Action: Action{Switch: "lamp", State: "off"}},
+	}
+	for i, j := range invalid {
+		if _, err := s.Add(j); err == nil {
+			t.Errorf("invalid job %d: want an error", i)
+		}
+	}
+
+	lightsOut.Cron = "0 23 * * *"
+	updated, err := s.Update(added.ID, lightsOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Get(added.ID); got.Cron != "0 23 * * *" || got.Next.Minute() != 0 || updated.ID != added.ID {
+		t.Errorf("got job %+v after update", got)
+	}
+	if _, err := s.Update("missing", lightsOut); err == nil {
+		t.Error("update of an unknown job: want an error")
+	}
+	if _, err := s.Update(added.ID, invalid[0]); err == nil {
+		t.Error("invalid update: want an error")
+	}
+
+	if err := s.Remove(added.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(added.ID); ok {
+		t.Error("job still there after removal")
+	}
+	if err := s.Remove(added.ID); err == nil {
+		t.Error("removing twice: want an error")
+	}
+	if jobs := s.List(); len(jobs) != 1 {
+		t.Errorf("got jobs %+v", jobs)
+	}
+}
+
+func TestSchedulerPersistence(t *testing.T) {
+	s, _ := newTestScheduler(t)
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	jobs := []Job{
+		{Name: "lights out", Cron: "30 23 * * *", Action: Action{Switch: "lamp", State: "off"}},
+		{At: &at, Action: Action{Switch: "lamp", State: "on"}},
+	}
+	for _, j := range jobs {
+		if _, err := s.Add(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := s.List()
+
+	restarted, err := New(s.path, Location{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := restarted.List()
+	if len(after) != len(before) {
+		t.Fatalf("got %d jobs after a restart, want %d", len(after), len(before))
+	}
+	for i := range before {
+		if after[i].ID != before[i].ID || !after[i].Next.Equal(before[i].Next) || after[i].Name != before[i].Name {
+			t.Errorf("job %d: got %+v, want %+v", i, after[i], before[i])
+		}
+	}
+	if _, err := os.Stat(s.path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	if err := ioutil.WriteFile(s.path, []byte("["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(s.path, Location{}); err == nil {
+		t.Error("corrupt schedule file: want an error")
+	}
+}
+
+func TestSchedulerDropsMissedJobs(t *testing.T) {
+	s, recorder := newTestScheduler(t)
+	past := time.Now().Add(-time.Hour)
+	jobs := []*Job{
+		{ID: "missed", At: &past, Action: Action{Switch: "lamp", State: "on"}},
+		{ID: "daily", Cron: "@daily", Action: Action{Switch: "lamp", State: "off"}},
+	}
+	jobBytes, err := json.Marshal(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(s.path, jobBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := New(s.path, Location{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.Get("missed"); ok {
+		t.Error("missed one-shot job was loaded")
+	}
+	if _, ok := restarted.Get("daily"); !ok {
+		t.Error("cron job was not loaded")
+	}
+	restarted.runDue(time.Now())
+	time.Sleep(20 * time.Millisecond)
+	if sent := recorder.Transmissions(); len(sent) != 0 {
+		t.Errorf("sent %v at startup", sent)
+	}
+
+	// the dropped job is gone from disk too
+	again, err := New(s.path, Location{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs := again.List(); len(jobs) != 1 {
+		t.Errorf("got jobs %+v", jobs)
+	}
+}
+
+func TestRunDue(t *testing.T) {
+	s, recorder := newTestScheduler(t)
+	at := time.Now().Add(time.Hour)
+	once, err := s.Add(Job{At: &at, Action: Action{Switch: "lamp", State: "on"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily, err := s.Add(Job{Cron: "@daily", Action: Action{Switch: "lamp", State: "off"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is due yet
+	s.runDue(time.Now())
+	time.Sleep(20 * time.Millisecond)
+	if sent := recorder.Transmissions(); len(sent) != 0 {
+		t.Fatalf("sent %v before anything was due", sent)
+	}
+
+	// the one-shot job runs once and is removed
+	s.runDue(at.Add(time.Minute))
+	waitForCodes(t, recorder, "1")
+	if _, ok := s.Get(once.ID); ok {
+		t.Error("one-shot job still scheduled after running")
+	}
+	restarted, err := New(s.path, Location{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.Get(once.ID); ok {
+		t.Error("one-shot job still persisted after running")
+	}
+
+	// the cron job runs and is rescheduled
+	next := daily.Next.Add(time.Second)
+	s.runDue(next)
+	waitForCodes(t, recorder, "1 2")
+	job, ok := s.Get(daily.ID)
+	if !ok || !job.Next.After(next) {
+		t.Errorf("cron job not rescheduled: %+v", job)
+	}
+	for deadline := time.Now().Add(2 * time.Second); job.LastRun == nil && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		job, _ = s.Get(daily.ID)
+	}
+	if job.LastRun == nil || job.LastError != "" {
+		t.Errorf("got job %+v, want a successful last run", job)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s, _ := newTestScheduler(t)
+	created, err := s.Add(Job{Cron: "@daily", Action: Action{Switch: "lamp", State: "off"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, url, body string
+		code              int
+	}{
+		{"GET", "/api/schedules", "", http.StatusOK},
+		{"POST", "/api/schedules", `{"cron": "0 7 * * 1-5", "action": {"switch": "lamp", "state": "on"}}`, http.StatusCreated},
+		{"POST", "/api/schedules", `{"cron": "0 7 * * 1-5", "action": {"switch": "garage", "state": "on"}}`, http.StatusBadRequest},
+		{"POST", "/api/schedules", `{"at": "2001-01-01T00:00:00Z", "action": {"switch": "lamp", "state": "on"}}`, http.StatusBadRequest},
+		{"POST", "/api/schedules", `{"cron"`, http.StatusBadRequest},
+		{"DELETE", "/api/schedules", "", http.StatusMethodNotAllowed},
+		{"GET", "/api/schedules/" + created.ID, "", http.StatusOK},
+		{"PUT", "/api/schedules/" + created.ID, `{"cron": "@hourly", "action": {"switch": "lamp", "state": "off"}}`, http.StatusOK},
+		{"PUT", "/api/schedules/" + created.ID, `{"action": {"switch": "lamp", "state": "off"}}`, http.StatusBadRequest},
+		{"POST", "/api/schedules/" + created.ID, "", http.StatusMethodNotAllowed},
+		{"DELETE", "/api/schedules/" + created.ID, "", http.StatusOK},
+		{"GET", "/api/schedules/" + created.ID, "", http.StatusNotFound},
+		{"PUT", "/api/schedules/missing", `{"cron": "@hourly", "action": {"switch": "lamp", "state": "off"}}`, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.Handler(w, httptest.NewRequest(test.method, test.url, strings.NewReader(test.body)))
+		if w.Code != test.code {
+			t.Errorf("%s %s %s: got %d, want %d: %s", test.method, test.url, test.body, w.Code, test.code, w.Body)
+		}
+	}
+	if jobs := s.List(); len(jobs) != 1 || jobs[0].Cron != "0 7 * * 1-5" {
+		t.Errorf("got jobs %+v", jobs)
+	}
+}
@@ -0,0 +1,133 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Solar events a job can be scheduled relative to
+const (
+	Sunrise = "sunrise"
+	Sunset  = "sunset"
+	Dawn    = "dawn"
+	Dusk    = "dusk"
+)
+
+// solar elevation (in degrees) of the sun's center at each event. Sunrise
+// and sunset account for refraction and the sun's radius, dawn and dusk are
+// the start and end of civil twilight.
+var solarElevations = map[string]float64{
+	Sunrise: -0.833,
+	Sunset:  -0.833,
+	Dawn:    -6,
+	Dusk:    -6,
+}
+
+// Location is where solar events are computed for. Latitude is positive
+// north of the equator, longitude positive east of Greenwich.
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// configured reports whether a location has been set
+func (l Location) configured() bool {
+	return l.Latitude != 0 || l.Longitude != 0
+}
+
+// Validate makes sure the coordinates are on earth
+func (l Location) Validate() error {
+	if l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180 {
+		return fmt.Errorf("error: invalid location %f, %f", l.Latitude, l.Longitude)
+	}
+	return nil
+}
+
+// Solar schedules a job every day relative to a solar event, e.g. 15 minutes
+// after sunset is {"event": "sunset", "offset": "15m"}
+type Solar struct {
+	Event  string `json:"event"`
+	Offset string `json:"offset,omitempty"`
+	offset time.Duration
+}
+
+// validate the event and parse the offset
+func (s *Solar) prepare() error {
+	s.Event = strings.ToLower(s.Event)
+	if _, ok := solarElevations[s.Event]; !ok {
+		return fmt.Errorf("error: unknown solar event %q", s.Event)
+	}
+	s.offset = 0
+	if s.Offset != "" {
+		offset, err := time.ParseDuration(s.Offset)
+		if err != nil {
+			return fmt.Errorf("error: invalid solar offset %q", s.Offset)
+		}
+		s.offset = offset
+	}
+	return nil
+}
+
+// Next returns the first occurrence of the event (plus offset) after t, or
+// the zero time if the sun doesn't rise or set there within the next year
+func (s *Solar) Next(t time.Time, l Location) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// start a day early: a negative offset can pull tomorrow's event into today
+	for i := -1; i <= 366; i++ {
+		event, err := SolarEvent(s.Event, day.AddDate(0, 0, i), l)
+		if err != nil {
+			continue
+		}
+		if next := event.Add(s.offset); next.After(t) {
+			return next.In(t.Location())
+		}
+	}
+	return time.Time{}
+}
+
+// ErrNoSolarEvent is returned when the sun doesn't reach the event's
+// elevation on a day, e.g. during polar day or night
+var ErrNoSolarEvent = errors.New("error: the sun does not reach that elevation on this day")
+
+// SolarEvent computes the time of a solar event on the calendar day of date
+// using the sunrise equation
+func SolarEvent(event string, date time.Time, l Location) (time.Time, error) {
+	elevation, ok := solarElevations[event]
+	if !ok {
+		return time.Time{}, fmt.Errorf("error: unknown solar event %q", event)
+	}
+
+	const rad = math.Pi / 180
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, time.UTC)
+	julianDate := float64(noon.Unix())/86400 + 2440587.5
+
+	// mean solar noon, solar mean anomaly and equation of the center
+	n := math.Round(julianDate - 2451545.0 + 0.0008)
+	meanNoon := n - l.Longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*math.Sin(anomaly*rad) + 0.0200*math.Sin(2*anomaly*rad) + 0.0003*math.Sin(3*anomaly*rad)
+
+	// ecliptic longitude, solar transit and declination of the sun
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := 2451545.0 + meanNoon + 0.0053*math.Sin(anomaly*rad) - 0.0069*math.Sin(2*ecliptic*rad)
+	sinDeclination := math.Sin(ecliptic*rad) * math.Sin(23.44*rad)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+
+	// hour angle of the event
+	cosHourAngle := (math.Sin(elevation*rad) - math.Sin(l.Latitude*rad)*sinDeclination) /
+		(math.Cos(l.Latitude*rad) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, ErrNoSolarEvent
+	}
+	hourAngle := math.Acos(cosHourAngle) / rad
+
+	julianEvent := transit + hourAngle/360
+	if event == Sunrise || event == Dawn {
+		julianEvent = transit - hourAngle/360
+	}
+	seconds := (julianEvent - 2440587.5) * 86400
+	return time.Unix(int64(math.Round(seconds)), 0).In(date.Location()), nil
+}
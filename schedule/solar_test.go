@@ -0,0 +1,142 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSolarEvent(t *testing.T) {
+	newYork := Location{Latitude: 40.7128, Longitude: -74.0060}
+	zone, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		zone = time.FixedZone("EDT", -4*60*60)
+	}
+	date := time.Date(2024, time.June, 21, 0, 0, 0, 0, zone)
+	at := func(hour, min int) time.Time {
+		return time.Date(2024, time.June, 21, hour, min, 0, 0, zone)
+	}
+
+	tests := []struct {
+		event string
+		want  time.Time
+	}{
+		{Sunrise, at(5, 25)},
+		{Sunset, at(20, 31)},
+		{Dawn, at(4, 52)},
+		{Dusk, at(21, 4)},
+	}
+	for _, test := range tests {
+		got, err := SolarEvent(test.event, date, newYork)
+		if err != nil {
+			t.Fatalf("%s: %v", test.event, err)
+		}
+		if diff := got.Sub(test.want); diff < -3*time.Minute || diff > 3*time.Minute {
+			t.Errorf("%s: got %s, want %s", test.event, got.In(zone), test.want)
+		}
+	}
+}
+
+func TestSolarEventErrors(t *testing.T) {
+	tests := []struct {
+		event    string
+		date     time.Time
+		location Location
+		want     error
+	}{
+		// midnight sun and polar night
+		{Sunset, time.Date(2024, time.June, 21, 0, 0, 0, 0, time.UTC), Location{Latitude: 78.2, Longitude: 15.6}, ErrNoSolarEvent},
+		{Sunrise, time.Date(2024, time.December, 21, 0, 0, 0, 0, time.UTC), Location{Latitude: 78.2, Longitude: 15.6}, ErrNoSolarEvent},
+		{"noon", time.Date(2024, time.June, 21, 0, 0, 0, 0, time.UTC), Location{Latitude: 40, Longitude: -74}, nil},
+	}
+	for _, test := range tests {
+		_, err := SolarEvent(test.event, test.date, test.location)
+		if err == nil || (test.want != nil && err != test.want) {
+			t.Errorf("%s at %v: got %v, want %v", test.event, test.location, err, test.want)
+		}
+	}
+}
+
+func TestSolarNext(t *testing.T) {
+	newYork := Location{Latitude: 40.7128, Longitude: -74.0060}
+	zone, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		zone = time.FixedZone("EDT", -4*60*60)
+	}
+	june := func(day, hour, min int) time.Time {
+		return time.Date(2024, time.June, day, hour, min, 0, 0, zone)
+	}
+	event := func(name string, day int) time.Time {
+		at, err := SolarEvent(name, june(day, 0, 0), newYork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+
+	tests := []struct {
+		solar Solar
+		from  time.Time
+		want  time.Time
+	}{
+		{Solar{Event: Sunset}, june(21, 12, 0), event(Sunset, 21)},
+		{Solar{Event: "SUNSET", Offset: "15m"}, june(21, 12, 0), event(Sunset, 21).Add(15 * time.Minute)},
+		{Solar{Event: Sunrise, Offset: "-30m"}, june(21, 4, 0), event(Sunrise, 21).Add(-30 * time.Minute)},
+		// today's event (plus offset) has passed: tomorrow's is next
+		{Solar{Event: Sunset}, june(21, 21, 0), event(Sunset, 22)},
+		{Solar{Event: Sunrise, Offset: "-30m"}, june(21, 5, 0), event(Sunrise, 22).Add(-30 * time.Minute)},
+		{Solar{Event: Sunset}, event(Sunset, 21), event(Sunset, 22)},
+		// a large offset moves the event to the next day
+		{Solar{Event: Sunset, Offset: "4h"}, june(21, 23, 0), event(Sunset, 21).Add(4 * time.Hour)},
+		{Solar{Event: Dusk, Offset: "-24h"}, june(21, 12, 0), event(Dusk, 22).Add(-24 * time.Hour)},
+	}
+	for i, test := range tests {
+		if err := test.solar.prepare(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		got := test.solar.Next(test.from, newYork)
+		if !got.Equal(test.want) {
+			t.Errorf("%d: %s %s from %s: got %s, want %s", i, test.solar.Event, test.solar.Offset, test.from, got, test.want)
+		}
+		if got.Location() != zone {
+			t.Errorf("%d: got time in %s, want %s", i, got.Location(), zone)
+		}
+	}
+}
+
+func TestSolarNextPolar(t *testing.T) {
+	svalbard := Location{Latitude: 78.2, Longitude: 15.6}
+	midsummer := time.Date(2024, time.June, 21, 12, 0, 0, 0, time.UTC)
+
+	// the midnight sun: the next sunset is at the end of August
+	sunset := Solar{Event: Sunset}
+	if err := sunset.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	next := sunset.Next(midsummer, svalbard)
+	if next.Month() != time.August {
+		t.Errorf("next sunset is %s, want late August", next)
+	}
+
+	// at the pole the sun circles the sky without an hour angle for the
+	// event on any day: there is no next one
+	if next := sunset.Next(midsummer, Location{Latitude: 90}); !next.IsZero() {
+		t.Errorf("next sunset at the pole is %s, want the zero time", next)
+	}
+}
+
+func TestSolarPrepare(t *testing.T) {
+	tests := []struct {
+		solar Solar
+		ok    bool
+	}{
+		{Solar{Event: "Sunrise"}, true},
+		{Solar{Event: Dusk, Offset: "-1h30m"}, true},
+		{Solar{Event: "noon"}, false},
+		{Solar{Event: Sunset, Offset: "later"}, false},
+	}
+	for _, test := range tests {
+		if err := test.solar.prepare(); (err == nil) != test.ok {
+			t.Errorf("%+v: got error %v, want ok %v", test.solar, err, test.ok)
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"homeautomation/alexa"
+	"homeautomation/auth"
 	"homeautomation/ddns"
 	"homeautomation/encrypt"
+	"homeautomation/filehelpers"
 	"homeautomation/rf"
+	"homeautomation/scene"
+	"homeautomation/schedule"
+	"homeautomation/vacation"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 )
@@ -20,8 +28,29 @@ type config struct {
 		Record string `json:"record"`
 	} `json:"cloudflare"`
 	LetsEncrypt struct {
-		API string
+		API       string
+		CA        string `json:"ca"`
+		Challenge string `json:"challenge"`
 	} `json:"letsencrypt"`
+	Encodings    []rf.Encoding           `json:"encodings"`
+	Switches     []rf.Switch             `json:"switches"`
+	Groups       map[string][]string     `json:"groups"`
+	Scenes       map[string][]scene.Step `json:"scenes"`
+	Transmitter  rf.TransmitterConfig    `json:"transmitter"`
+	Repeat       rf.RepeatConfig         `json:"repeat"`
+	Queue        rf.QueueConfig          `json:"queue"`
+	StateFile    string                  `json:"stateFile"`
+	TimerFile    string                  `json:"timerFile"`
+	Receiver     rf.ReceiverConfig       `json:"receiver"`
+	ScheduleFile string                  `json:"scheduleFile"`
+	Location     schedule.Location       `json:"location"`
+	Vacation     vacation.Config         `json:"vacation"`
+	Auth         struct {
+		Keys []auth.Key `json:"keys"`
+	} `json:"auth"`
+	HTTP struct {
+		Mode string `json:"mode"`
+	} `json:"http"`
 }
 
 func getConfig() *config {
@@ -40,13 +69,103 @@ func getConfig() *config {
 	return &c
 }
 
+// saveSwitches writes the switches back to the config file, leaving the
+// other sections untouched
+func saveSwitches(switches []rf.Switch) error {
+	configBytes, err := ioutil.ReadFile("config.json")
+	if err != nil {
+		return err
+	}
+	sections := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(configBytes, &sections); err != nil {
+		return err
+	}
+	if sections["switches"], err = json.Marshal(switches); err != nil {
+		return err
+	}
+	return filehelpers.WriteJSON("config.json", sections)
+}
+
+// redirectToTLS sends plain HTTP requests to the same path on the TLS listener
+func redirectToTLS(host, port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := "https://" + net.JoinHostPort(host, port) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
 func main() {
 	port := flag.String("port", "8080", "The port to run the server on")
+	tlsPort := flag.String("tls-port", "31415", "The port to run the TLS server on")
 	flag.Parse()
 
 	// Read the config
 	config := getConfig()
 
+	// RF Switches
+	for _, encoding := range config.Encodings {
+		if err := rf.RegisterEncoding(encoding); err != nil {
+			log.Fatalf("error: invalid encoding configuration: %q\n", err)
+		}
+	}
+	if err := rf.SetSwitches(config.Switches); err != nil {
+		log.Fatalf("error: invalid switch configuration: %q\n", err)
+	}
+	if len(config.Switches) == 0 {
+		log.Println("warning: no switches configured")
+	}
+	if err := rf.SetGroups(config.Groups); err != nil {
+		log.Fatalf("error: invalid group configuration: %q\n", err)
+	}
+	if err := scene.SetScenes(config.Scenes); err != nil {
+		log.Fatalf("error: invalid scene configuration: %q\n", err)
+	}
+	transmitter, err := rf.NewTransmitter(config.Transmitter)
+	if err != nil {
+		log.Fatalf("error: invalid transmitter configuration: %q\n", err)
+	}
+	rf.SetTransmitter(transmitter)
+	if err := rf.SetRepeatDefaults(config.Repeat); err != nil {
+		log.Fatalf("error: invalid repeat configuration: %q\n", err)
+	}
+	rf.SetQueue(rf.NewQueue(config.Queue))
+	if config.StateFile == "" {
+		config.StateFile = "state.json"
+	}
+	if err := rf.LoadState(config.StateFile); err != nil {
+		log.Printf("error: could not read switch state: %q\n", err)
+	}
+	if config.TimerFile == "" {
+		config.TimerFile = "timers.json"
+	}
+	if err := rf.LoadTimers(config.TimerFile); err != nil {
+		log.Printf("error: could not read timers: %q\n", err)
+	}
+	rf.SetSaveHook(saveSwitches)
+
+	// RF Receiver
+	if config.Receiver.Type != "" {
+		log.Println("STARTING: RF Receiver")
+		go rf.Receive(config.Receiver)
+	}
+
+	// Scheduler
+	if config.ScheduleFile == "" {
+		config.ScheduleFile = "schedules.json"
+	}
+	scheduler, err := schedule.New(config.ScheduleFile, config.Location)
+	if err != nil {
+		log.Fatalf("error: could not read schedules: %q\n", err)
+	}
+	log.Println("STARTING: Scheduler")
+	go scheduler.Run()
+
+	// Vacation Mode
+	away, err := vacation.New(config.Vacation)
+	if err != nil {
+		log.Fatalf("error: invalid vacation configuration: %q\n", err)
+	}
+
 	// DDNS
 	log.Println("STARTING: DDNS Updater")
 	go ddns.NewUpdater(
@@ -56,29 +175,93 @@ func main() {
 		config.Cloudflare.Record,
 	).Update()
 
-	// Bootstrap the domain
+	// Let's Encrypt
 	domainStr := config.Cloudflare.Record + "." + config.Cloudflare.Domain
 	domain := encrypt.NewDomain(domainStr, config.LetsEncrypt.API)
-	log.Println("STARTING: Let's Encrypt Bootstrap")
-	err := domain.Bootstrap()
-
-	if err != nil {
-		log.Println(err)
+	if config.LetsEncrypt.CA != "" {
+		if err := domain.TrustCA(config.LetsEncrypt.CA); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Go Renew in 30 days
-	log.Println("STARTING: Let's Encrypt 30 Day Refresh")
-	go domain.RefreshCertificate()
+	// challenge (string): "http-01 | dns-01 | tls-alpn-01"
+	switch config.LetsEncrypt.Challenge {
+	case "", "http-01":
+	case "tls-alpn-01":
+		domain.Solver = encrypt.NewTLSALPNSolver()
+	case "dns-01":
+		domain.Solver = encrypt.NewDNSSolver(ddns.NewUpdater(
+			config.Cloudflare.Email,
+			config.Cloudflare.APIKey,
+			config.Cloudflare.Domain,
+			config.Cloudflare.Record,
+		))
+	default:
+		log.Fatalf("error: invalid letsencrypt challenge: %q\n", config.LetsEncrypt.Challenge)
+	}
+	// http-01 validation always connects to port 80
+	if _, ok := domain.Solver.(*encrypt.HTTPSolver); ok && *port != "80" {
+		log.Printf("warning: http-01 challenges are answered on port %s: forward port 80 to it or certificates won't renew\n", *port)
+	}
 
 	// API Handlers
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/switch", rf.SwitchHandler)
+	mux.HandleFunc("/api/switch/learn", rf.LearnHandler)
+	mux.HandleFunc("/api/switches", rf.SwitchesHandler)
+	mux.HandleFunc("/api/switches/", rf.SwitchesHandler)
+	mux.HandleFunc("/api/group", rf.GroupHandler)
+	mux.HandleFunc("/api/scene/", scene.Handler)
+	mux.HandleFunc("/api/schedules", scheduler.Handler)
+	mux.HandleFunc("/api/schedules/", scheduler.Handler)
+	mux.HandleFunc("/api/timers", rf.TimersHandler)
+	mux.HandleFunc("/api/timers/", rf.TimersHandler)
+	mux.HandleFunc("/api/vacation", away.Handler)
+	mux.HandleFunc("/api/queue", rf.QueueHandler)
+	mux.HandleFunc("/api/events", rf.EventsHandler)
+
+	// API Authentication
+	authenticator, err := auth.New(config.Auth.Keys)
+	if err != nil {
+		log.Fatalf("error: invalid auth configuration: %q\n", err)
+	}
+	api := authenticator.Wrap(mux)
+
+	// Without api keys the API is only served over plain HTTP, which these
+	// modes don't do
+	if !authenticator.Enabled() && (config.HTTP.Mode == "redirect" || config.HTTP.Mode == "disable") {
+		log.Fatalf("error: http mode %q needs api keys: without them the API is not served over TLS\n", config.HTTP.Mode)
+	}
 
 	// HTTP Server
-	log.Println("STARTING: Raspberry PI Homeautomation API Server")
-	go func() {
-		log.Fatal(http.ListenAndServe(":"+*port, mux))
-	}()
+	// http-01 challenges are answered here whatever the mode
+	plain := http.NewServeMux()
+	plain.HandleFunc(encrypt.ChallengePath, domain.ChallengeHandler)
+	// mode (string): "serve | redirect | disable"
+	switch config.HTTP.Mode {
+	case "", "serve":
+		log.Println("STARTING: Raspberry PI Homeautomation API Server")
+		plain.Handle("/", api)
+	case "redirect":
+		log.Println("STARTING: Redirecting HTTP to HTTPS")
+		plain.Handle("/", redirectToTLS(domainStr, *tlsPort))
+	case "disable":
+		log.Println("SKIPPING: plain HTTP API Server is disabled")
+		if _, ok := domain.Solver.(*encrypt.HTTPSolver); !ok {
+			plain = nil
+		}
+	default:
+		log.Fatalf("error: invalid http mode: %q\n", config.HTTP.Mode)
+	}
+	if plain != nil {
+		plainListener, err := net.Listen("tcp", ":"+*port)
+		if err != nil {
+			log.Fatalf("error: could not listen on %q: %q\n", ":"+*port, err)
+		}
+		go func() {
+			log.Fatal(http.Serve(plainListener, plain))
+		}()
+	}
 
 	// HTTPS
 	smux := http.NewServeMux()
@@ -86,10 +269,38 @@ func main() {
 	// Alexa!
 	smux.HandleFunc("/alexa", alexa.Handler)
 
-	log.Println("STARTING: Alexa Handler")
-	log.Fatal(http.ListenAndServeTLS(":31415",
-		domainStr+".crt",
-		domainStr+".key",
-		smux,
-	))
+	// The API is served over TLS as well, but only behind api keys as the
+	// TLS port is forwarded to the internet for Alexa
+	if authenticator.Enabled() {
+		log.Println("STARTING: Alexa Handler and HTTPS API Server")
+		smux.Handle("/api/", api)
+	} else {
+		log.Println("STARTING: Alexa Handler")
+		log.Println("SKIPPING: HTTPS API Server: no api keys configured")
+	}
+	server := &http.Server{
+		Addr:    ":" + *tlsPort,
+		Handler: smux,
+		TLSConfig: &tls.Config{
+			GetCertificate: domain.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1", encrypt.ACMETLSProto},
+		},
+	}
+	tlsListener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatalf("error: could not listen on %q: %q\n", server.Addr, err)
+	}
+	go func() {
+		log.Fatal(server.ServeTLS(tlsListener, "", ""))
+	}()
+
+	// Bootstrap the domain now that the TLS listener can answer challenges
+	log.Println("STARTING: Let's Encrypt Bootstrap")
+	if err := domain.Bootstrap(); err != nil {
+		log.Println(err)
+	}
+
+	// Renew before the certificate expires
+	log.Println("STARTING: Let's Encrypt Certificate Renewal")
+	domain.RefreshCertificate()
 }
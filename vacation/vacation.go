@@ -0,0 +1,390 @@
+package vacation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"homeautomation/apihelpers"
+	"homeautomation/filehelpers"
+	"homeautomation/rf"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxActivity is how many actions are remembered for the API
+const maxActivity = 100
+
+// Window is a daily period during which switches are turned on and off at
+// random to make the house look occupied. Switches stay on for a random
+// duration between MinOn and MaxOn and off for one between MinOff and MaxOff.
+// A window whose end is before its start runs past midnight.
+type Window struct {
+	Switches []string `json:"switches"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	MinOn    string   `json:"minOn"`
+	MaxOn    string   `json:"maxOn"`
+	MinOff   string   `json:"minOff"`
+	MaxOff   string   `json:"maxOff"`
+
+	start, end     time.Duration
+	minOn, maxOn   time.Duration
+	minOff, maxOff time.Duration
+}
+
+// Config describes the windows and where the mode is persisted
+type Config struct {
+	File    string   `json:"file"`
+	Windows []Window `json:"windows"`
+}
+
+// Entry is an action taken by vacation mode
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Switch string    `json:"switch"`
+	State  string    `json:"state"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Status is the current state of vacation mode
+type Status struct {
+	Enabled  bool      `json:"enabled"`
+	Since    time.Time `json:"since,omitempty"`
+	Activity []Entry   `json:"activity"`
+}
+
+// Vacation simulates presence while enabled
+type Vacation struct {
+	file    string
+	windows []Window
+
+	mu       sync.Mutex
+	enabled  bool
+	since    time.Time
+	stop     chan struct{}
+	workers  sync.WaitGroup
+	activity []Entry
+	on       map[string]bool
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
+
+	// serializes Enable and Disable so a run is fully stopped before the
+	// next one starts
+	transition sync.Mutex
+}
+
+// persisted mode and the switches it left on, so that they can still be
+// turned off after a restart
+type savedMode struct {
+	Enabled bool      `json:"enabled"`
+	Since   time.Time `json:"since"`
+	On      []string  `json:"on,omitempty"`
+}
+
+// New validates the windows and restores the persisted mode, resuming the
+// simulation if it was enabled
+func New(c Config) (*Vacation, error) {
+	if c.File == "" {
+		c.File = "vacation.json"
+	}
+	v := &Vacation{
+		file: c.File,
+		on:   make(map[string]bool),
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for i, w := range c.Windows {
+		if err := w.prepare(); err != nil {
+			return nil, fmt.Errorf("error: vacation window %d: %v", i, err)
+		}
+		v.windows = append(v.windows, w)
+	}
+
+	modeBytes, err := ioutil.ReadFile(v.file)
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mode := savedMode{}
+	if err := json.Unmarshal(modeBytes, &mode); err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, s := range mode.On {
+		v.on[s] = true
+	}
+	if mode.Enabled {
+		log.Println("action: resuming vacation mode")
+		v.start(mode.Since)
+	}
+	return v, nil
+}
+
+// parse a "15:04" time of day into the duration since midnight
+func parseClock(clock string) (time.Duration, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// validate a window and parse its times
+func (w *Window) prepare() error {
+	if len(w.Switches) == 0 {
+		return errors.New("no switches")
+	}
+	for _, s := range w.Switches {
+		if _, _, err := rf.FindSwitch(s); err != nil {
+			return err
+		}
+	}
+	var err error
+	if w.start, err = parseClock(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return err
+	}
+	if w.end <= w.start {
+		w.end += 24 * time.Hour
+	}
+	durations := []struct {
+		value  string
+		target *time.Duration
+	}{
+		{w.MinOn, &w.minOn}, {w.MaxOn, &w.maxOn}, {w.MinOff, &w.minOff}, {w.MaxOff, &w.maxOff},
+	}
+	for _, d := range durations {
+		if *d.target, err = time.ParseDuration(d.value); err != nil || *d.target <= 0 {
+			return fmt.Errorf("invalid duration %q", d.value)
+		}
+	}
+	if w.maxOn < w.minOn || w.maxOff < w.minOff {
+		return errors.New("maximum durations must not be shorter than minimum durations")
+	}
+	return nil
+}
+
+// next returns the start and end of the window occurrence that ends after
+// t. If t is inside the window the start is t itself.
+func (w *Window) next(t time.Time) (time.Time, time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// yesterday's window may still be running past midnight
+	for day := -1; ; day++ {
+		base := midnight.AddDate(0, 0, day)
+		start, end := base.Add(w.start), base.Add(w.end)
+		if end.After(t) {
+			if start.Before(t) {
+				start = t
+			}
+			return start, end
+		}
+	}
+}
+
+// random duration in [min, max]
+func (v *Vacation) between(min, max time.Duration) time.Duration {
+	v.rngMu.Lock()
+	defer v.rngMu.Unlock()
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(v.rng.Int63n(int64(max-min)+1))
+}
+
+// Enable turns on vacation mode
+func (v *Vacation) Enable() error {
+	v.transition.Lock()
+	defer v.transition.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.enabled {
+		return nil
+	}
+	if len(v.windows) == 0 {
+		return errors.New("error: no vacation windows configured")
+	}
+	log.Println("action: enabling vacation mode")
+	v.start(time.Now())
+	return v.save()
+}
+
+// Disable turns off vacation mode and every switch it turned on
+func (v *Vacation) Disable() error {
+	v.transition.Lock()
+	defer v.transition.Unlock()
+	v.mu.Lock()
+	if !v.enabled {
+		v.mu.Unlock()
+		return nil
+	}
+	log.Println("action: disabling vacation mode")
+	v.enabled = false
+	close(v.stop)
+	err := v.save()
+	v.mu.Unlock()
+
+	v.workers.Wait()
+	v.mu.Lock()
+	var on []string
+	for s := range v.on {
+		on = append(on, s)
+	}
+	v.mu.Unlock()
+	for _, s := range on {
+		v.set(s, "off")
+	}
+	return err
+}
+
+// Status reports whether vacation mode is on and what it did recently
+func (v *Vacation) Status() Status {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	activity := make([]Entry, len(v.activity))
+	copy(activity, v.activity)
+	return Status{Enabled: v.enabled, Since: v.since, Activity: activity}
+}
+
+// start a worker for every switch in every window. Callers must hold v.mu
+func (v *Vacation) start(since time.Time) {
+	v.enabled = true
+	v.since = since
+	v.stop = make(chan struct{})
+	for i := range v.windows {
+		for _, s := range v.windows[i].Switches {
+			v.workers.Add(1)
+			go v.simulate(&v.windows[i], s, v.stop)
+		}
+	}
+}
+
+// turn a switch on and off at random within every occurrence of the window
+func (v *Vacation) simulate(w *Window, s string, stop chan struct{}) {
+	defer v.workers.Done()
+	for {
+		start, end := w.next(time.Now())
+		// don't start exactly on time, that's a giveaway
+		start = start.Add(v.between(0, w.maxOff))
+		if !sleepUntil(start, stop) {
+			return
+		}
+		for time.Now().Before(end) {
+			v.set(s, "on")
+			off := time.Now().Add(v.between(w.minOn, w.maxOn))
+			if off.After(end) {
+				off = end
+			}
+			if !sleepUntil(off, stop) {
+				return
+			}
+			v.set(s, "off")
+			if !sleepUntil(time.Now().Add(v.between(w.minOff, w.maxOff)), stop) {
+				return
+			}
+		}
+	}
+}
+
+// wait until t, returning false if stopped first
+func sleepUntil(t time.Time, stop chan struct{}) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// set a switch and record what happened
+func (v *Vacation) set(s, state string) {
+	entry := Entry{Time: time.Now(), Switch: s, State: state}
+	log.Printf("action: vacation mode turning switch %q %s\n", s, state)
+	if err := rf.SetSwitch(s, state); err != nil {
+		log.Printf("error: vacation mode could not turn switch %q %s: %q\n", s, state, err)
+		entry.Error = err.Error()
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if state == "on" {
+		v.on[s] = true
+	} else {
+		delete(v.on, s)
+	}
+	v.activity = append(v.activity, entry)
+	if len(v.activity) > maxActivity {
+		v.activity = v.activity[len(v.activity)-maxActivity:]
+	}
+	if err := v.save(); err != nil {
+		log.Printf("error: could not persist vacation mode: %q\n", err)
+	}
+}
+
+// persist the mode. Callers must hold v.mu
+func (v *Vacation) save() error {
+	mode := savedMode{Enabled: v.enabled, Since: v.since}
+	for s := range v.on {
+		mode.On = append(mode.On, s)
+	}
+	sort.Strings(mode.On)
+	return filehelpers.WriteJSON(v.file, mode)
+}
+
+// Handler is an HTTP Handler for vacation mode.
+// GET returns whether vacation mode is on and what it did recently
+// PUT or POST with a JSON body {"enabled": true | false} or the query param
+// enabled (bool) turns it on or off
+func (v *Vacation) Handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		apihelpers.EncodeJSON(w, http.StatusOK, v.Status())
+		return
+	case http.MethodPut, http.MethodPost:
+	default:
+		apihelpers.EncodeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPost)
+		return
+	}
+
+	request := struct {
+		Enabled *bool `json:"enabled"`
+	}{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			apihelpers.EncodeError(w, http.StatusBadRequest, "Invalid JSON Body")
+			return
+		}
+	} else if enabled := r.URL.Query().Get("enabled"); enabled != "" {
+		value := enabled == "true" || enabled == "on" || enabled == "1"
+		request.Enabled = &value
+	}
+	if request.Enabled == nil {
+		apihelpers.EncodeError(w, http.StatusBadRequest, "Missing Enabled")
+		return
+	}
+
+	var err error
+	if *request.Enabled {
+		err = v.Enable()
+	} else {
+		err = v.Disable()
+	}
+	if err != nil {
+		apihelpers.EncodeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	apihelpers.EncodeJSON(w, http.StatusOK, v.Status())
+}
@@ -0,0 +1,184 @@
+package vacation
+
+import (
+	"homeautomation/rf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a window that is open from an hour ago until an hour from now, switching
+// with the given durations
+func windowAroundNow(on, off string) Window {
+	now := time.Now()
+	return Window{
+		Switches: []string{"lamp"},
+		Start:    now.Add(-time.Hour).Format("15:04"),
+		End:      now.Add(time.Hour).Format("15:04"),
+		MinOn:    on, MaxOn: on, MinOff: off, MaxOff: off,
+	}
+}
+
+// a vacation mode for the window persisting to a temporary directory, with a
+// switch sending codes to a recorder. Transmissions are spaced out so that
+// workers take a while to stop.
+func newTestVacation(t *testing.T, w Window) (*Vacation, *rf.Recorder) {
+	recorder := &rf.Recorder{}
+	rf.SetTransmitter(recorder)
+	rf.SetQueue(rf.NewQueue(rf.QueueConfig{AirGap: 10}))
+	if err := rf.SetSwitches([]rf.Switch{{Name: "lamp", On: 1, Off: 2, Protocol: "arctech_switch"}}); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "vacation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	v, err := New(Config{File: filepath.Join(dir, "vacation.json"), Windows: []Window{w}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, recorder
+}
+
+// a vacation mode that flips a switch every few milliseconds
+func newBusyVacation(t *testing.T) *Vacation {
+	v, _ := newTestVacation(t, windowAroundNow("1ms", "2ms"))
+	return v
+}
+
+func TestEnableDisable(t *testing.T) {
+	v := newBusyVacation(t)
+	if err := v.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := v.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	status := v.Status()
+	if status.Enabled || len(status.Activity) == 0 {
+		t.Errorf("got status %+v, want disabled with some activity", status)
+	}
+	if state, _ := rf.GetState("lamp"); state.State != "off" {
+		t.Errorf("lamp left %q", state.State)
+	}
+
+	// the mode is persisted
+	resumed, err := New(Config{File: v.file, Windows: v.windows})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Status().Enabled {
+		t.Error("disabled mode resumed as enabled")
+	}
+}
+
+func TestEnableWhileDisabling(t *testing.T) {
+	v := newBusyVacation(t)
+	for i := 0; i < 20; i++ {
+		if err := v.Enable(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		// a disable must not wait for the workers of the enable after it
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			v.Disable()
+		}()
+		go func() {
+			defer wg.Done()
+			v.Enable()
+		}()
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("disable blocked by a later enable")
+		}
+		if err := v.Disable(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResumeTurnsOff(t *testing.T) {
+	// the workers wait an hour before doing anything themselves
+	v, recorder := newTestVacation(t, windowAroundNow("1h", "1h"))
+	if err := v.Enable(); err != nil {
+		t.Fatal(err)
+	}
+	v.set("lamp", "on")
+
+	// stop the workers without turning anything off, as if the server died
+	v.mu.Lock()
+	close(v.stop)
+	v.mu.Unlock()
+	v.workers.Wait()
+	recorder.Reset()
+
+	resumed, err := New(Config{File: v.file, Windows: v.windows})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.Status().Enabled {
+		t.Fatal("enabled mode not resumed")
+	}
+	if err := resumed.Disable(); err != nil {
+		t.Fatal(err)
+	}
+	want := rf.Transmission{Protocol: "arctech_switch", Code: "2"}
+	if sent := recorder.Transmissions(); len(sent) != 1 || sent[0] != want {
+		t.Errorf("sent %v, want %v", sent, want)
+	}
+
+	// nothing is left to turn off after that
+	again, err := New(Config{File: v.file, Windows: v.windows})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.on) != 0 {
+		t.Errorf("switches still recorded as on: %v", again.on)
+	}
+}
+
+func TestWindowNext(t *testing.T) {
+	day := func(d, hour, min int) time.Time {
+		return time.Date(2024, time.March, d, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		start, end string
+		at         time.Time
+		from, to   time.Time
+	}{
+		{"18:00", "23:00", day(10, 12, 0), day(10, 18, 0), day(10, 23, 0)},
+		{"18:00", "23:00", day(10, 19, 0), day(10, 19, 0), day(10, 23, 0)},
+		{"18:00", "23:00", day(10, 23, 30), day(11, 18, 0), day(11, 23, 0)},
+		// past midnight
+		{"22:00", "02:00", day(10, 1, 0), day(10, 1, 0), day(10, 2, 0)},
+		{"22:00", "02:00", day(10, 12, 0), day(10, 22, 0), day(11, 2, 0)},
+		{"22:00", "02:00", day(10, 23, 0), day(10, 23, 0), day(11, 2, 0)},
+	}
+	newTestVacation(t, windowAroundNow("1h", "1h"))
+	for _, test := range tests {
+		w := windowAroundNow("1h", "1h")
+		w.Start, w.End = test.start, test.end
+		if err := w.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		from, to := w.next(test.at)
+		if !from.Equal(test.from) || !to.Equal(test.to) {
+			t.Errorf("%s-%s at %s: got %s to %s, want %s to %s", test.start, test.end, test.at, from, to, test.from, test.to)
+		}
+	}
+}